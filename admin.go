@@ -0,0 +1,108 @@
+package cluster
+
+import(
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// State of the cluster as served by Cluster.AdminHandler
+type AdminState struct {
+	Nodes 		[]AdminNode 	`json:"nodes"`
+	DeadNodes 	[]AdminNode 	`json:"deadNodes"`
+	Config 		AdminConfig 	`json:"config"`
+}
+
+type AdminNode struct {
+	Host 			string 			`json:"host"`
+	State 			string 			`json:"state"`
+	InFlight 		int64 			`json:"inFlight"`
+	Latency 		time.Duration 	`json:"latencyNanos"`
+	Requests 		int64 			`json:"requests"`
+	Successes 		int64 			`json:"successes"`
+	Failures 		int64 			`json:"failures"`
+	AverageLatency 	time.Duration 	`json:"averageLatencyNanos"`
+}
+
+// The settings of the config that can be represented as JSON, hooks and TLS settings are left
+// out
+type AdminConfig struct {
+	Hosts 					[]string 			`json:"hosts"`
+	Strategy 				string 				`json:"strategy,omitempty"`
+	NodeReanimationAfter 	time.Duration 		`json:"nodeReanimationAfterNanos"`
+	HealthCheckPath 		string 				`json:"healthCheckPath,omitempty"`
+	MaxRetries 				int 				`json:"maxRetries"`
+	FailureThreshold 		int 				`json:"failureThreshold"`
+	BreakerThreshold 		int 				`json:"breakerThreshold"`
+	Weights 				map[string]int 		`json:"weights,omitempty"`
+	Roles 					map[string]string 	`json:"roles,omitempty"`
+	Tiers 					map[string]int 		`json:"tiers,omitempty"`
+	Groups 					map[string]string 	`json:"groups,omitempty"`
+	PathGroups 				map[string]string 	`json:"pathGroups,omitempty"`
+	Zones 					map[string]string 	`json:"zones,omitempty"`
+	LocalZone 				string 				`json:"localZone,omitempty"`
+}
+
+func adminNode(node *Node) AdminNode {
+	stats := node.Stats()
+	return AdminNode{
+		Host: node.Host,
+		State: node.State().String(),
+		InFlight: node.InFlight(),
+		Latency: node.Latency(),
+		Requests: stats.Requests,
+		Successes: stats.Successes,
+		Failures: stats.Failures,
+		AverageLatency: stats.AverageLatency(),
+	}
+}
+
+// Current state of the nodes and config, read under the locks like Stats
+func(cluster *Cluster) AdminState() AdminState {
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	cluster.DeadPoolMutex.RLock()
+	defer cluster.DeadPoolMutex.RUnlock()
+	config := cluster.config
+	state := AdminState{
+		Nodes: make([]AdminNode, 0, len(cluster.Nodes)),
+		DeadNodes: make([]AdminNode, 0, len(cluster.DeadPool)),
+		Config: AdminConfig{
+			Hosts: config.Hosts,
+			Strategy: config.Strategy,
+			NodeReanimationAfter: config.reanimationDelay(),
+			HealthCheckPath: config.HealthCheckPath,
+			MaxRetries: config.MaxRetries,
+			FailureThreshold: config.FailureThreshold,
+			BreakerThreshold: config.BreakerThreshold,
+			Weights: config.Weights,
+			Roles: config.Roles,
+			Tiers: config.Tiers,
+			Groups: config.Groups,
+			PathGroups: config.PathGroups,
+			Zones: config.Zones,
+			LocalZone: config.LocalZone,
+		},
+	}
+	for _, node := range cluster.Nodes {
+		state.Nodes = append(state.Nodes, adminNode(node))
+	}
+	for _, node := range cluster.DeadPool {
+		state.DeadNodes = append(state.DeadNodes, adminNode(node))
+	}
+	return state
+}
+
+// AdminHandler serves the AdminState of the cluster as JSON, e.g. to be mounted at
+// /debug/cluster
+func(cluster *Cluster) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster.AdminState())
+	})
+}
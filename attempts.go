@@ -0,0 +1,39 @@
+package cluster
+
+import(
+	"context"
+	"net/http"
+)
+
+// Attempts a request took, found in the context of the request of the response returned by
+// Cluster.Do
+type AttemptInfo struct {
+	// Number of nodes the request was sent to, including hedged requests
+	Attempts 	int
+	// Hosts of the nodes in the order the request was sent to them
+	Hosts 		[]string
+}
+
+type attemptInfoKey struct {}
+
+func AttemptInfoFromContext(ctx context.Context) (AttemptInfo, bool) {
+	info, ok := ctx.Value(attemptInfoKey{}).(AttemptInfo)
+	return info, ok
+}
+
+// Returns the attempts the request of the response returned by Cluster.Do took
+func AttemptInfoFromResponse(resp *http.Response) (AttemptInfo, bool) {
+	if resp == nil || resp.Request == nil {
+		return AttemptInfo{}, false
+	}
+	return AttemptInfoFromContext(resp.Request.Context())
+}
+
+// Stores the attempts in the context of the request of the response
+func withAttemptInfo(resp *http.Response, hosts []string) {
+	if resp == nil || resp.Request == nil {
+		return
+	}
+	info := AttemptInfo{Attempts: len(hosts), Hosts: hosts}
+	resp.Request = resp.Request.WithContext(context.WithValue(resp.Request.Context(), attemptInfoKey{}, info))
+}
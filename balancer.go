@@ -0,0 +1,393 @@
+package cluster
+
+import(
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"math/rand"
+	"sort"
+	"hash/crc32"
+	"strconv"
+)
+
+// Number of points each node occupies on the ring of a ConsistentHashBalancer by default
+const DefaultVirtualNodes = 100
+
+// A Balancer picks the node to forward a request to out of the currently live nodes. The nodes
+// slice is owned by the cluster and must not be retained or modified. Returning nil signals that
+// no node is eligible for the request.
+type Balancer interface {
+	Pick(nodes []*Node, req *http.Request) *Node
+}
+
+// Implemented by balancers keeping state per node, told the live nodes of the cluster whenever
+// they change while Pick only gets the nodes eligible for the request
+type liveNodesBalancer interface {
+	setLiveNodes(nodes []*Node)
+}
+
+// RandomBalancer picks nodes at random, proportionally to their weight if Weights is given
+type RandomBalancer struct {
+	Weights 			map[string]int
+	// Whether nodes discovered via SRV records missing from Weights are weighted by their record
+	srvWeights 			bool
+	mutex 				sync.Mutex
+	// Weights of the live nodes, rebuilt whenever they change
+	weighted 			weightedNodes
+}
+
+func(balancer *RandomBalancer) Weight(host string) int {
+	weight, ok := balancer.Weights[host]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+// Weight of the node and whether it keeps a chance of being picked at a weight of zero, which
+// only nodes weighted by their SRV record do
+func(balancer *RandomBalancer) weight(node *Node) (int, bool) {
+	if _, ok := balancer.Weights[node.Host]; !ok && balancer.srvWeights && node.srv.Load() {
+		return int(node.srvWeight.Load()), true
+	}
+	return balancer.Weight(node.Host), false
+}
+
+// Draws from the global math/rand source, which is seeded once at startup and safe for concurrent
+// use, instead of reseeding on every request
+func(balancer *RandomBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	if len(balancer.Weights) == 0 && !balancer.srvWeights {
+		return nodes[rand.Intn(len(nodes))]
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if !balancer.weighted.covers(nodes) {
+		// Without published live nodes the table grows by the nodes it is asked to pick from
+		tableNodes := append([]*Node{}, balancer.weighted.nodes ...)
+		for _, node := range nodes {
+			if _, ok := balancer.weighted.weights[node]; !ok {
+				tableNodes = append(tableNodes, node)
+			}
+		}
+		balancer.weighted.build(tableNodes, balancer.weight)
+	}
+	return balancer.weighted.pick(nodes)
+}
+
+// Rebuilds the weights for the live nodes of the cluster so that nodes filtered for single
+// requests keep their entries
+func(balancer *RandomBalancer) setLiveNodes(nodes []*Node) {
+	if len(balancer.Weights) == 0 && !balancer.srvWeights {
+		return
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if !sameNodes(balancer.weighted.nodes, nodes) {
+		balancer.weighted.build(nodes, balancer.weight)
+	}
+}
+
+// Weighted random selection among nodes following RFC 2782: nodes are picked proportionally to
+// their weight, nodes of zero weight never unless they keep a small chance like SRV targets do
+type weightedNodes struct {
+	nodes 				[]*Node
+	cumulativeWeights 	[]int
+	// Nodes of zero weight that keep a chance of being picked
+	zeroWeights 		[]*Node
+	weights 			map[*Node]weightEntry
+}
+
+type weightEntry struct {
+	weight 		int
+	keepChance 	bool
+}
+
+func(weighted *weightedNodes) build(nodes []*Node, weight func(*Node) (int, bool)) {
+	weighted.nodes = append(weighted.nodes[:0], nodes ...)
+	weighted.cumulativeWeights = weighted.cumulativeWeights[:0]
+	weighted.zeroWeights = weighted.zeroWeights[:0]
+	weighted.weights = make(map[*Node]weightEntry, len(nodes))
+	total := 0
+	for _, node := range nodes {
+		nodeWeight, keepChance := weight(node)
+		if nodeWeight < 0 {
+			nodeWeight = 0
+		}
+		weighted.weights[node] = weightEntry{nodeWeight, keepChance}
+		if nodeWeight == 0 && keepChance {
+			weighted.zeroWeights = append(weighted.zeroWeights, node)
+		}
+		total += nodeWeight
+		weighted.cumulativeWeights = append(weighted.cumulativeWeights, total)
+	}
+}
+
+// Reports whether all nodes have weights
+func(weighted *weightedNodes) covers(nodes []*Node) bool {
+	if sameNodes(weighted.nodes, nodes) {
+		return true
+	}
+	for _, node := range nodes {
+		if _, ok := weighted.weights[node]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Picks one of the nodes, which must all have weights
+func(weighted *weightedNodes) pick(nodes []*Node) *Node {
+	if !sameNodes(weighted.nodes, nodes) {
+		return weighted.pickFiltered(nodes)
+	}
+	total := 0
+	if len(weighted.cumulativeWeights) > 0 {
+		total = weighted.cumulativeWeights[len(weighted.cumulativeWeights)-1]
+	}
+	var drawn int
+	if len(weighted.zeroWeights) > 0 {
+		// The zero-weight nodes come first in the running sum and are picked when 0 is drawn out
+		// of 0 to the total weight inclusive
+		if drawn = rand.Intn(total+1); drawn == 0 {
+			return weighted.zeroWeights[rand.Intn(len(weighted.zeroWeights))]
+		}
+	} else {
+		if total == 0 {
+			return nil
+		}
+		drawn = rand.Intn(total)+1
+	}
+	// Zero-weight nodes share the cumulative value of their predecessor and are never found
+	// as the first index reaching the drawn value
+	return weighted.nodes[sort.SearchInts(weighted.cumulativeWeights, drawn)]
+}
+
+// Same selection as pick among a subset of the nodes, summing up their weights on the fly
+func(weighted *weightedNodes) pickFiltered(nodes []*Node) *Node {
+	total, zeroWeights := 0, 0
+	for _, node := range nodes {
+		entry := weighted.weights[node]
+		if entry.weight == 0 && entry.keepChance {
+			zeroWeights++
+		}
+		total += entry.weight
+	}
+	var drawn int
+	if zeroWeights > 0 {
+		if drawn = rand.Intn(total+1); drawn == 0 {
+			drawn = rand.Intn(zeroWeights)
+			for _, node := range nodes {
+				if entry := weighted.weights[node]; entry.weight == 0 && entry.keepChance {
+					if drawn == 0 {
+						return node
+					}
+					drawn--
+				}
+			}
+		}
+	} else {
+		if total == 0 {
+			return nil
+		}
+		drawn = rand.Intn(total)+1
+	}
+	for _, node := range nodes {
+		if drawn -= weighted.weights[node].weight; drawn <= 0 {
+			return node
+		}
+	}
+	return nil
+}
+
+// PowerOfTwoChoicesBalancer picks two distinct nodes at random and takes the one with fewer
+// requests in flight
+type PowerOfTwoChoicesBalancer struct {}
+
+func(balancer *PowerOfTwoChoicesBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	first := rand.Intn(len(nodes))
+	// Drawing from the remaining nodes keeps the second choice distinct from the first
+	second := rand.Intn(len(nodes) - 1)
+	if second >= first {
+		second++
+	}
+	if nodes[second].InFlight() < nodes[first].InFlight() {
+		return nodes[second]
+	}
+	return nodes[first]
+}
+
+// RoundRobinBalancer cycles through the nodes in order
+type RoundRobinBalancer struct {
+	counter 	uint64
+}
+
+func(balancer *RoundRobinBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	// The counter keeps growing across evictions, taking it modulo the current node count
+	// keeps the rotation in bounds whenever the slice shrinks or grows
+	idx := (atomic.AddUint64(&balancer.counter, 1) - 1) % uint64(len(nodes))
+	return nodes[idx]
+}
+
+// LeastConnectionsBalancer picks the node with the fewest requests in flight, breaking ties
+// at random
+type LeastConnectionsBalancer struct {}
+
+func(balancer *LeastConnectionsBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	var picked *Node
+	var least int64
+	ties := 0
+	for _, node := range nodes {
+		inFlight := node.InFlight()
+		switch {
+		case picked == nil || inFlight < least:
+			picked, least, ties = node, inFlight, 1
+		case inFlight == least:
+			// Reservoir sampling keeps every tied node equally likely without a second pass
+			ties++
+			if rand.Intn(ties) == 0 {
+				picked = node
+			}
+		}
+	}
+	return picked
+}
+
+// ConsistentHashBalancer maps requests onto a hash ring of the live nodes so that the same key
+// keeps hitting the same node. When a node leaves the ring only its keys move on to the next
+// node and they return once the node is back.
+type ConsistentHashBalancer struct {
+	// HashKey extracts the routing key from a request, defaults to the URL path
+	HashKey 		func(*http.Request) string
+	// VirtualNodes is the number of ring points per node, defaults to DefaultVirtualNodes
+	VirtualNodes 	int
+	mutex 			sync.RWMutex
+	nodes 			[]*Node
+	ring 			[]uint32
+	ringNodes 		map[uint32]*Node
+	onRingNodes 	map[*Node]bool
+}
+
+// Routes by the value of the given request header
+func HeaderHashKey(header string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(header)
+	}
+}
+
+func PathHashKey(req *http.Request) string {
+	return req.URL.Path
+}
+
+func(balancer *ConsistentHashBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	balancer.mutex.RLock()
+	if !balancer.onRing(nodes) {
+		balancer.mutex.RUnlock()
+		balancer.mutex.Lock()
+		if !balancer.onRing(nodes) {
+			// Without published live nodes the ring grows by the nodes it is asked to pick from
+			ringNodes := append([]*Node{}, balancer.nodes ...)
+			for _, node := range nodes {
+				if !containsNode(ringNodes, node) {
+					ringNodes = append(ringNodes, node)
+				}
+			}
+			balancer.buildRing(ringNodes)
+		}
+		balancer.mutex.Unlock()
+		balancer.mutex.RLock()
+	}
+	defer balancer.mutex.RUnlock()
+	hashKey := balancer.HashKey
+	if hashKey == nil {
+		hashKey = PathHashKey
+	}
+	hash := crc32.ChecksumIEEE([]byte(hashKey(req)))
+	idx := sort.Search(len(balancer.ring), func(i int) bool { return balancer.ring[i] >= hash })
+	// All given nodes are on the ring, fewer of them means some were filtered for the request
+	// whose keys move on to the next node on the ring
+	filtered := len(nodes) < len(balancer.nodes)
+	for i := range balancer.ring {
+		node := balancer.ringNodes[balancer.ring[(idx+i) % len(balancer.ring)]]
+		if !filtered || containsNode(nodes, node) {
+			return node
+		}
+	}
+	return nil
+}
+
+// Rebuilds the ring for the live nodes of the cluster so that nodes filtered for single requests
+// keep their points on the ring
+func(balancer *ConsistentHashBalancer) setLiveNodes(nodes []*Node) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if !sameNodes(balancer.nodes, nodes) {
+		balancer.buildRing(nodes)
+	}
+}
+
+// Reports whether all nodes have points on the ring. The caller must hold the mutex.
+func(balancer *ConsistentHashBalancer) onRing(nodes []*Node) bool {
+	if sameNodes(balancer.nodes, nodes) {
+		return true
+	}
+	for _, node := range nodes {
+		if !balancer.onRingNodes[node] {
+			return false
+		}
+	}
+	return true
+}
+
+func(balancer *ConsistentHashBalancer) buildRing(nodes []*Node) {
+	virtualNodes := balancer.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	balancer.nodes = append([]*Node{}, nodes ...)
+	balancer.ring = make([]uint32, 0, len(nodes)*virtualNodes)
+	balancer.ringNodes = make(map[uint32]*Node, len(nodes)*virtualNodes)
+	balancer.onRingNodes = make(map[*Node]bool, len(nodes))
+	for _, node := range nodes {
+		balancer.onRingNodes[node] = true
+		for i := 0; i<virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(node.Host + "#" + strconv.Itoa(i)))
+			// On a collision the first node keeps the point so the ring stays deterministic
+			if _, ok := balancer.ringNodes[hash]; ok {
+				continue
+			}
+			balancer.ring = append(balancer.ring, hash)
+			balancer.ringNodes[hash] = node
+		}
+	}
+	sort.Slice(balancer.ring, func(i, j int) bool { return balancer.ring[i] < balancer.ring[j] })
+}
+
+func sameNodes(a, b []*Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package cluster
+
+import (
+	"testing"
+	"net/http"
+	"fmt"
+	"time"
+)
+
+func TestLeastConnectionsBalancerPicksLeastBusyNode(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	nodes[0].inFlight.Add(3)
+	nodes[1].inFlight.Add(1)
+	nodes[2].inFlight.Add(2)
+	balancer := &LeastConnectionsBalancer{}
+	for i := 0; i<10; i++ {
+		if node := balancer.Pick(nodes, nil); node != nodes[1] {
+			t.Fatalf("Expected least busy node %s to be picked, got %s", nodes[1].Host, node.Host)
+		}
+	}
+}
+
+func TestLeastConnectionsBalancerBreaksTiesRandomly(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	nodes[2].inFlight.Add(1)
+	balancer := &LeastConnectionsBalancer{}
+	picked := map[*Node]int{}
+	for i := 0; i<200; i++ {
+		picked[balancer.Pick(nodes, nil)]++
+	}
+	if picked[nodes[0]] == 0 || picked[nodes[1]] == 0 || picked[nodes[2]] != 0 {
+		t.Fatalf("Expected ties between idle nodes to be broken randomly, got picks %v", picked)
+	}
+}
+
+func TestPowerOfTwoChoicesBalancerAvoidsBusiestNode(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	nodes[0].inFlight.Add(5)
+	nodes[1].inFlight.Add(1)
+	balancer := &PowerOfTwoChoicesBalancer{}
+	picked := map[*Node]int{}
+	for i := 0; i<300; i++ {
+		picked[balancer.Pick(nodes, nil)]++
+	}
+	// The busiest node loses every pair it is drawn into, the idlest node wins every pair
+	if picked[nodes[0]] != 0 || picked[nodes[1]] == 0 || picked[nodes[2]] <= picked[nodes[1]] {
+		t.Fatalf("Expected picks to favour less busy nodes, got picks %v", picked)
+	}
+	if node := balancer.Pick(nodes[:1], nil); node != nodes[0] {
+		t.Fatalf("Expected the only node to be picked, got %v", node)
+	}
+}
+
+func TestNodeReleasesInFlightSlotOnError(t *testing.T) {
+	node := NewNode("localhost:324786")
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := node.Do(req); err == nil {
+		t.Fatalf("Expected request against invalid port to fail")
+	}
+	if inFlight := node.InFlight(); inFlight != 0 {
+		t.Fatalf("Expected no request in flight after failure, got %d", inFlight)
+	}
+}
+
+func TestConsistentHashBalancerRemapsOnlyEvictedKeys(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	balancer := &ConsistentHashBalancer{HashKey: HeaderHashKey("X-Cache-Key")}
+	keys := []string{}
+	for i := 0; i<100; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+	pick := func(nodes []*Node, key string) *Node {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Cache-Key", key)
+		return balancer.Pick(nodes, req)
+	}
+	initial := map[string]*Node{}
+	for _, key := range keys {
+		initial[key] = pick(nodes, key)
+		if again := pick(nodes, key); again != initial[key] {
+			t.Fatalf("Expected key %s to stick to node %s, got %s", key, initial[key].Host, again.Host)
+		}
+	}
+	evicted := nodes[1]
+	remaining := []*Node{nodes[0], nodes[2]}
+	for _, key := range keys {
+		node := pick(remaining, key)
+		if initial[key] != evicted && node != initial[key] {
+			t.Fatalf("Expected key %s of live node %s not to move, got %s", key, initial[key].Host, node.Host)
+		}
+		if node == evicted {
+			t.Fatalf("Expected key %s not to be routed to evicted node", key)
+		}
+	}
+	for _, key := range keys {
+		if node := pick(nodes, key); node != initial[key] {
+			t.Fatalf("Expected key %s to return to node %s after reanimation, got %s", key, initial[key].Host, node.Host)
+		}
+	}
+}
+
+func TestConsistentHashBalancerKeepsRingOfLiveNodesWhenFiltered(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	balancer := &ConsistentHashBalancer{HashKey: HeaderHashKey("X-Cache-Key")}
+	balancer.setLiveNodes(nodes)
+	ring := balancer.ring
+	pick := func(nodes []*Node, key string) *Node {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Cache-Key", key)
+		return balancer.Pick(nodes, req)
+	}
+	initial := map[string]*Node{}
+	for i := 0; i<100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		initial[key] = pick(nodes, key)
+	}
+	// Requests filtering different nodes, e.g. by route, alternate without moving the keys of
+	// the nodes they have in common
+	subsets := [][]*Node{{nodes[0], nodes[1]}, {nodes[1], nodes[2]}}
+	for round := 0; round<3; round++ {
+		for _, subset := range subsets {
+			for key, owner := range initial {
+				node := pick(subset, key)
+				if !containsNode(subset, node) {
+					t.Fatalf("Expected key %s to be routed to one of the given nodes, got %s", key, node.Host)
+					return
+				}
+				if containsNode(subset, owner) && node != owner {
+					t.Fatalf("Expected key %s to stay on node %s, got %s", key, owner.Host, node.Host)
+					return
+				}
+			}
+		}
+	}
+	if &balancer.ring[0] != &ring[0] {
+		t.Fatalf("Expected the ring of the live nodes not to be rebuilt for filtered nodes")
+	}
+}
+
+func TestConsistentHashBalancerKeepsVirtualNodesOfHostsApart(t *testing.T) {
+	// Without a separator index 1 of the first and index 11 of the second host share a key
+	nodes := []*Node{NewNode("12.0.0.1:80"), NewNode("2.0.0.1:80")}
+	balancer := &ConsistentHashBalancer{VirtualNodes: 12}
+	balancer.setLiveNodes(nodes)
+	points := map[*Node]int{}
+	for _, node := range balancer.ringNodes {
+		points[node]++
+	}
+	for _, node := range nodes {
+		if points[node] != 12 {
+			t.Fatalf("Expected node %s to own 12 points on the ring, got %d", node.Host, points[node])
+			return
+		}
+	}
+}
+
+func TestLatencyBalancerFavoursFasterNodes(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2")}
+	nodes[0].observeLatency(100*time.Millisecond)
+	nodes[1].observeLatency(10*time.Millisecond)
+	balancer := &LatencyBalancer{}
+	for i := 0; i<10; i++ {
+		if node := balancer.Pick(nodes, nil); node != nodes[1] {
+			t.Fatalf("Expected the faster node to be picked, got %s", node.Host)
+		}
+	}
+	for i := 0; i<20; i++ {
+		nodes[1].observeLatency(time.Second)
+	}
+	if latency := nodes[1].Latency(); latency < 800*time.Millisecond {
+		t.Fatalf("Expected the moving average to follow the slower latencies, got %v", latency)
+	}
+	if node := balancer.Pick(nodes, nil); node != nodes[0] {
+		t.Fatalf("Expected the now faster node to be picked, got %s", node.Host)
+	}
+}
+
+func TestStickySessionBalancerKeepsSessionsOnTheirNode(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	balancer := &StickySessionBalancer{SessionKey: CookieHashKey("session"), TTL: 50*time.Millisecond}
+	pick := func(nodes []*Node, session string) *Node {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		return balancer.Pick(nodes, req)
+	}
+	initial := pick(nodes, "a")
+	for i := 0; i<20; i++ {
+		if node := pick(nodes, "a"); node != initial {
+			t.Fatalf("Expected session to stick to node %s, got %s", initial.Host, node.Host)
+		}
+	}
+	var others []*Node
+	for _, node := range nodes {
+		if node != initial {
+			others = append(others, node)
+		}
+	}
+	// A node only unavailable for this request keeps its sessions
+	if node := pick(others, "a"); node == initial || pick(nodes, "a") != initial {
+		t.Fatalf("Expected session to return to its live node %s", initial.Host)
+	}
+	initial.setState(NodeDead)
+	moved := pick(others, "a")
+	initial.setState(NodeHealthy)
+	if node := pick(nodes, "a"); node != moved {
+		t.Fatalf("Expected session to be remapped to %s once its node died, got %s", moved.Host, node.Host)
+	}
+	// Idle sessions expire and get balanced anew
+	time.Sleep(60*time.Millisecond)
+	if node := pick(others[:1], "b"); node != others[0] {
+		t.Fatalf("Expected new session on the only node, got %s", node.Host)
+	}
+	balancer.mutex.Lock()
+	_, kept := balancer.sessions["a"]
+	balancer.mutex.Unlock()
+	if kept {
+		t.Fatalf("Expected the idle session to be dropped after its TTL")
+	}
+}
+
+func TestStickySessionBalancerBoundsItsSessions(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	config := &ClusterConfig{Strategy: StrategyStickySession, SessionKey: HeaderHashKey("X-Session"),
+		Weights: map[string]int{"localhost:1": 1, "localhost:2": 1, "localhost:3": 0}}
+	balancer := config.NewBalancer().(*StickySessionBalancer)
+	balancer.MaxSessions = 100
+	pick := func(nodes []*Node, session string) *Node {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session", session)
+		return balancer.Pick(nodes, req)
+	}
+	for i := 0; i<1000; i++ {
+		if node := pick(nodes, fmt.Sprintf("session-%d", i)); node == nodes[2] {
+			t.Fatalf("Expected new sessions to be balanced by weight, got zero-weight node %s", node.Host)
+			return
+		}
+	}
+	balancer.mutex.Lock()
+	sessions := len(balancer.sessions)
+	balancer.mutex.Unlock()
+	if sessions > 100 {
+		t.Fatalf("Expected at most 100 sessions to be kept, got %d", sessions)
+	}
+	// The most recent session survives the cap, sessions of nodes leaving the cluster do not
+	recent := pick(nodes, "session-999")
+	balancer.setLiveNodes([]*Node{recent})
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	for key, session := range balancer.sessions {
+		if session.node != recent {
+			t.Fatalf("Expected session %s of a node no longer live to be dropped", key)
+		}
+	}
+	if _, ok := balancer.sessions["session-999"]; !ok {
+		t.Fatalf("Expected the most recent session to be kept")
+	}
+}
+
+func TestRandomBalancerPicksZeroWeightSRVTargetsOnlyByChance(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	for _, node := range nodes {
+		node.srv.Store(true)
+	}
+	balancer := &RandomBalancer{srvWeights: true}
+	picked := map[*Node]int{}
+	for i := 0; i<100; i++ {
+		picked[balancer.Pick(nodes, nil)]++
+	}
+	// Without any weight all targets are equally likely
+	if len(picked) != 3 {
+		t.Fatalf("Expected all zero-weight targets to be picked, got picks %v", picked)
+	}
+	balancer = &RandomBalancer{srvWeights: true, Weights: map[string]int{"localhost:1": 0}}
+	nodes[2].srvWeight.Store(1000)
+	picked = map[*Node]int{}
+	for i := 0; i<1000; i++ {
+		picked[balancer.Pick(nodes, nil)]++
+	}
+	// The weight map excludes its zero-weight host, the zero-weight target keeps a chance of
+	// 1 in 1001
+	if picked[nodes[0]] != 0 || picked[nodes[1]] > 10 || picked[nodes[2]] < 990 {
+		t.Fatalf("Expected zero weights to be honoured, got picks %v", picked)
+	}
+}
+
+func TestRandomBalancerSpreadsPicksMadeInQuickSuccession(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3"), NewNode("localhost:4"), NewNode("localhost:5")}
+	balancer := &RandomBalancer{}
+	picked := map[*Node]int{}
+	repeats := 0
+	var last *Node
+	for i := 0; i<1000; i++ {
+		node := balancer.Pick(nodes, nil)
+		if node == last {
+			repeats++
+		}
+		picked[node]++
+		last = node
+	}
+	// Reseeding with the clock would repeat the same pick for all requests of the same instant
+	if len(picked) != len(nodes) || repeats > 500 {
+		t.Fatalf("Expected picks spread over all nodes, got picks %v with %d repeats", picked, repeats)
+	}
+}
+
+func TestRandomBalancerKeepsWeightsOfLiveNodesWhenFiltered(t *testing.T) {
+	nodes := []*Node{NewNode("localhost:1"), NewNode("localhost:2"), NewNode("localhost:3")}
+	balancer := &RandomBalancer{Weights: map[string]int{"localhost:1": 1, "localhost:2": 9, "localhost:3": 0}}
+	balancer.setLiveNodes(nodes)
+	// Only a rebuilt table would see the changed weight
+	balancer.Weights = map[string]int{"localhost:1": 1, "localhost:2": 0, "localhost:3": 0}
+	picked := map[*Node]int{}
+	for i := 0; i<1000; i++ {
+		// Requests filtering different nodes alternate
+		subset := []*Node{nodes[0], nodes[1]}
+		if i%2 == 1 {
+			subset = []*Node{nodes[0], nodes[2]}
+		}
+		node := balancer.Pick(subset, nil)
+		if !containsNode(subset, node) {
+			t.Fatalf("Expected one of the given nodes to be picked, got %v", node)
+			return
+		}
+		picked[node]++
+	}
+	// Among the first and second node the weights of the live nodes hold, the zero-weight third
+	// node is never picked so the first node takes all requests filtering the second
+	if picked[nodes[2]] != 0 || picked[nodes[1]] < 400 || picked[nodes[0]] < 500 {
+		t.Fatalf("Expected weights of the live nodes to be honoured among the given nodes, got picks %v", picked)
+	}
+}
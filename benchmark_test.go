@@ -0,0 +1,176 @@
+package cluster
+
+import(
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var benchmarkStrategies = []string{
+	StrategyRandom,
+	StrategyRoundRobin,
+	StrategyLeastConnections,
+	StrategyConsistentHash,
+	StrategyPowerOfTwoChoices,
+	StrategyLatency,
+}
+
+var benchmarkNodeCounts = []int{1, 5, 25}
+
+// Starts count servers with the test handler minus its per-request logging, which benchmarks
+// would print on every run
+func startBenchmarkServers(b *testing.B, count int) (hosts []string, servers []*httptest.Server) {
+	for i := 0; i<count; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(writePort))
+		hosts = append(hosts, strings.TrimPrefix(ts.URL, "http://"))
+		servers = append(servers, ts)
+	}
+	return
+}
+
+func benchmarkCluster(b *testing.B) *Cluster {
+	cluster, err := NewCluster(&ClusterConfig{Hosts: []string{"localhost:1", "localhost:2", "localhost:3", "localhost:4"}})
+	if err != nil {
+		b.Fatalf("Unexpected error when create cluster: %v", err)
+	}
+	b.Cleanup(cluster.Close)
+	return cluster
+}
+
+func benchmarkDo(b *testing.B, cluster *Cluster) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		b.Fatalf("Unexpected error when sending request: %v", err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Requests sent one after another through every strategy, the difference between the strategies
+// and node counts is the selection overhead
+func BenchmarkDo(b *testing.B) {
+	for _, strategy := range benchmarkStrategies {
+		for _, count := range benchmarkNodeCounts {
+			b.Run(fmt.Sprintf("%s/%d", strategy, count), func(b *testing.B) {
+				hosts, servers := startBenchmarkServers(b, count)
+				defer closeTestServers(servers)
+				cluster, err := NewCluster(&ClusterConfig{Hosts: hosts, Strategy: strategy})
+				if err != nil {
+					b.Fatalf("Unexpected error when create cluster: %v", err)
+				}
+				defer cluster.Close()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i<b.N; i++ {
+					benchmarkDo(b, cluster)
+				}
+			})
+		}
+	}
+}
+
+// Requests sent concurrently from GOMAXPROCS goroutines
+func BenchmarkDoConcurrent(b *testing.B) {
+	for _, strategy := range benchmarkStrategies {
+		b.Run(strategy, func(b *testing.B) {
+			hosts, servers := startBenchmarkServers(b, 5)
+			defer closeTestServers(servers)
+			cluster, err := NewCluster(&ClusterConfig{Hosts: hosts, Strategy: strategy})
+			if err != nil {
+				b.Fatalf("Unexpected error when create cluster: %v", err)
+			}
+			defer cluster.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					benchmarkDo(b, cluster)
+				}
+			})
+		})
+	}
+}
+
+// Node selection alone, without sending any request
+func BenchmarkSelectNode(b *testing.B) {
+	for _, strategy := range benchmarkStrategies {
+		for _, count := range benchmarkNodeCounts {
+			b.Run(fmt.Sprintf("%s/%d", strategy, count), func(b *testing.B) {
+				var hosts []string
+				for i := 0; i<count; i++ {
+					hosts = append(hosts, fmt.Sprintf("localhost:%d", i+1))
+				}
+				cluster, err := NewCluster(&ClusterConfig{Hosts: hosts, Strategy: strategy})
+				if err != nil {
+					b.Fatalf("Unexpected error when create cluster: %v", err)
+				}
+				defer cluster.Close()
+				req, _ := http.NewRequest("GET", "/", nil)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i<b.N; i++ {
+					state := cluster.snapshot()
+					state.config.selectNode(state.nodes, state.balancer, req, nil)
+				}
+			})
+		}
+	}
+}
+
+// Reading the nodes under the read lock as requests did before the snapshot was published. The
+// config is referenced rather than copied like in the snapshot so both read the same data.
+func BenchmarkNodesReadLocked(b *testing.B) {
+	cluster := benchmarkCluster(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cluster.NodesMutex.RLock()
+			nodes, balancer, config := cluster.Nodes, cluster.balancer, &cluster.config
+			cluster.NodesMutex.RUnlock()
+			_, _, _ = nodes, balancer, config
+		}
+	})
+}
+
+func BenchmarkNodesReadSnapshot(b *testing.B) {
+	cluster := benchmarkCluster(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			state := cluster.snapshot()
+			_, _, _ = state.nodes, state.balancer, state.config
+		}
+	})
+}
+
+// Selection while another goroutine keeps changing the nodes
+func BenchmarkSelectWithConcurrentUpdates(b *testing.B) {
+	cluster := benchmarkCluster(b)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cluster.RemoveHost("localhost:4")
+			cluster.AddHost("localhost:4")
+		}
+	}()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			state := cluster.snapshot()
+			state.config.selectNode(state.nodes, state.balancer, nil, nil)
+		}
+	})
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import(
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	// Requests flow to the node as usual
+	BreakerClosed BreakerState = iota
+	// The node is skipped until the cooldown passed
+	BreakerOpen
+	// A single trial request decides whether the breaker closes or opens again
+	BreakerHalfOpen
+)
+
+// Circuit breaker of a node, only used if ClusterConfig.BreakerThreshold is set
+type breaker struct {
+	mutex 		sync.Mutex
+	state 		BreakerState
+	failures 	int
+	openedAt 	time.Time
+	// Whether the trial request of the half-open breaker is in flight
+	trial 		bool
+}
+
+// Reports without side effects whether acquire would currently let a request pass
+func(breaker *breaker) available(cooldown time.Duration) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case BreakerOpen:
+		return time.Since(breaker.openedAt) >= cooldown
+	case BreakerHalfOpen:
+		return !breaker.trial
+	}
+	return true
+}
+
+// Lets a request pass the breaker, once the cooldown of an open breaker passed it turns half-open
+// and lets exactly one trial request pass
+func(breaker *breaker) acquire(cooldown time.Duration) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case BreakerOpen:
+		if time.Since(breaker.openedAt) < cooldown {
+			return false
+		}
+		breaker.state = BreakerHalfOpen
+		breaker.trial = true
+		return true
+	case BreakerHalfOpen:
+		if breaker.trial {
+			return false
+		}
+		breaker.trial = true
+		return true
+	}
+	return true
+}
+
+// Releases a trial request that ended without a verdict on the node, e.g. when cancelled
+func(breaker *breaker) release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.trial = false
+}
+
+func(breaker *breaker) success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.state = BreakerClosed
+	breaker.failures = 0
+	breaker.trial = false
+}
+
+// Records a failed request, opening the breaker once threshold consecutive requests failed or
+// right away if the trial request of the half-open breaker failed
+func(breaker *breaker) failure(threshold int) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen || breaker.failures >= threshold {
+		breaker.state = BreakerOpen
+		breaker.openedAt = time.Now()
+		breaker.trial = false
+	}
+}
+
+func(breaker *breaker) currentState() BreakerState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
@@ -0,0 +1,24 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerReopensWhenTrialFails(t *testing.T) {
+	breaker := &breaker{}
+	breaker.failure(1)
+	if breaker.acquire(time.Hour) {
+		t.Fatalf("Expected open breaker to reject requests during cooldown")
+	}
+	if !breaker.acquire(0) || breaker.currentState() != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to let a trial pass once the cooldown passed")
+	}
+	if breaker.acquire(0) {
+		t.Fatalf("Expected half-open breaker to let only a single trial pass")
+	}
+	breaker.failure(1)
+	if breaker.currentState() != BreakerOpen {
+		t.Fatalf("Expected failed trial to open the breaker again")
+	}
+}
@@ -0,0 +1,74 @@
+package cluster
+
+import(
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Outcome of a broadcast request on a single node
+type NodeResponse struct {
+	Host 		string
+	Response 	*http.Response
+	Err 		error
+}
+
+// Sends a copy of the request to every live node concurrently and returns the outcome of each,
+// in the order of the live nodes. The request body is buffered once so every node receives it.
+// Callers must close the bodies of all responses returned. Cancelling the request context
+// cancels all outstanding requests. Failing nodes are only evicted with
+// ClusterConfig.BroadcastEvicts set.
+func(cluster *Cluster) Broadcast(req *http.Request) []NodeResponse {
+	state := cluster.snapshot()
+	nodes, config := state.nodes, state.config
+	req = config.withDefaultHeaders(req)
+	responses := make([]NodeResponse, len(nodes))
+	for i, node := range nodes {
+		responses[i].Host = node.Host
+	}
+	if cluster.ctx.Err() != nil {
+		for i := range responses {
+			responses[i].Err = ErrClusterClosed
+		}
+		return responses
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			for i := range responses {
+				responses[i].Err = err
+			}
+			return responses
+		}
+	}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			responses[i].Err = errCallbackPanicked
+			config.callback("broadcast request", func() {
+				nodeReq := req.Clone(req.Context())
+				if body != nil {
+					nodeReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+					nodeReq.GetBody = func() (io.ReadCloser, error) {
+						return ioutil.NopCloser(bytes.NewReader(body)), nil
+					}
+					nodeReq.ContentLength = int64(len(body))
+				}
+				resp, err := config.doNode(node, nodeReq)
+				responses[i].Response, responses[i].Err = resp, err
+				if config.BroadcastEvicts && req.Context().Err() == nil && config.isNodeDead(resp, err) {
+					cluster.evict(node, err)
+				}
+			})
+		}(i, node)
+	}
+	wg.Wait()
+	return responses
+}
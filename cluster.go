@@ -3,18 +3,417 @@
 package cluster
 
 import(
+	"context"
+	"crypto/tls"
+	"math"
+	"math/rand"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"syscall"
+	"strings"
 	"fmt"
 	"regexp"
 	"errors"
-	"math/rand"
 	"time"
+	"sync/atomic"
+	"maps"
+	"slices"
+)
+
+// Node selection strategies supported by ClusterConfig.Strategy
+const (
+	StrategyRandom 		= "random"
+	StrategyRoundRobin 	= "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyConsistentHash 	= "consistent-hash"
+	StrategyPowerOfTwoChoices 	= "p2c"
+	StrategyLatency 	= "ewma"
+	StrategyStickySession 	= "sticky-session"
 )
 
 type ClusterConfig struct {
+	// Hosts are host:port pairs or paths of Unix sockets prefixed with UnixHostPrefix
 	Hosts 						  	[]string
 	NodeReanimationAfterSeconds 	int64
+	// NodeReanimationAfter takes precedence over NodeReanimationAfterSeconds when set
+	NodeReanimationAfter 			time.Duration
+	// MaxReanimationAfter enables doubling the reanimation delay of a node each time it is
+	// evicted again within MaxReanimationAfter of its reanimation, up to MaxReanimationAfter.
+	// Once a node stayed alive for longer it starts over with the regular delay. With
+	// HealthCheckPath the HealthCheckInterval is doubled instead and a relapsing node is only
+	// probed again once the time it was backed off by passed.
+	MaxReanimationAfter 			time.Duration
+	// ReanimationJitter spreads the reanimation delay of each evicted node randomly by up to the
+	// fraction of it in either direction, e.g. 0.2 for 80% to 120% of the delay, so nodes evicted
+	// at once do not return at once
+	ReanimationJitter 				float64
+	// Strategy selects how Cluster.Do picks a node, defaults to StrategyRandom
+	Strategy 						string
+	// Weights biases random selection towards hosts with a higher weight, hosts missing from
+	// the map default to a weight of 1 while a weight of 0 excludes the host from selection
+	Weights 						map[string]int
+	// HashKey extracts the key requests are routed by with StrategyConsistentHash, defaults to
+	// the URL path
+	HashKey 						func(*http.Request) string
+	// SessionKey extracts the session of a request with StrategyStickySession, e.g. HeaderHashKey
+	// or CookieHashKey, and SessionTTL is how long an idle session stays with its node, zero
+	// for as long as the node is alive. New sessions are balanced by Weights and sessions are
+	// kept across config updates.
+	SessionKey 						func(*http.Request) string
+	SessionTTL 						time.Duration
+	// Groups assigns hosts a group, hosts missing from it are in DefaultGroup. Requests are then
+	// only sent to and fail over within a single group, the one given to Cluster.DoGroup or else
+	// the group PathGroups maps the longest prefix of their URL path to, or DefaultGroup if none
+	// matches.
+	Groups 							map[string]string
+	PathGroups 						map[string]string
+	// GroupReanimationAfter overrides NodeReanimationAfter for the nodes of a group
+	GroupReanimationAfter 			map[string]time.Duration
+	// Roles assigns hosts a role, e.g. RolePrimary or RoleReplica, requests are then routed to the
+	// nodes of the role MethodRoles maps their method to and fail over within that group. If no
+	// node of the role is available requests fall back to any node.
+	Roles 							map[string]string
+	// MethodRoles maps request methods to roles, defaults to DefaultMethodRoles
+	MethodRoles 					map[string]string
+	// Tiers assigns hosts a failover tier, hosts missing from it are in tier 0. Requests are only
+	// sent to the nodes of the lowest tier available, e.g. backups in tier 1 only get requests once
+	// all primaries in tier 0 are dead or were tried, and lose them again once a primary is
+	// reanimated.
+	Tiers 							map[string]int
+	// Zones assigns hosts the zone they are located in and LocalZone is the zone of the cluster.
+	// Requests are only sent to nodes of other zones once no node of the local zone is available,
+	// within the best tier of Tiers.
+	Zones 							map[string]string
+	LocalZone 						string
+	// SuspectShare is the share of its regular requests a suspect node receives, e.g. 0.1 for a
+	// tenth, nodes turn suspect after a failure or their reanimation and healthy again once they
+	// served a request successfully. Zero gives suspect nodes their full share.
+	SuspectShare 					float64
+	// SlowStartDuration ramps the share of requests a reanimated node receives up linearly from
+	// none to its full share over the duration, zero disables slow start
+	SlowStartDuration 				time.Duration
+	// OutlierErrorRate ejects nodes whose share of errors and 5xx responses exceeds it, e.g. 0.5,
+	// once they served OutlierMinRequests within OutlierWindow. MaxOutlierEjection caps the
+	// fraction of nodes that may be dead for outliers to be ejected. Zero disables outlier
+	// detection.
+	OutlierErrorRate 				float64
+	OutlierWindow 					time.Duration
+	OutlierMinRequests 				int
+	MaxOutlierEjection 				float64
+	// MaxLatency ejects nodes whose moving average latency stays above it for MaxLatencyWindow,
+	// which defaults to DefaultMaxLatencyWindow, even though they respond successfully. Nodes
+	// turn suspect as soon as their latency exceeds it. Zero disables latency ejection.
+	MaxLatency 						time.Duration
+	MaxLatencyWindow 				time.Duration
+	// MinHealthyNodes is the number of live nodes below which nodes are no longer evicted, so a
+	// failing cluster keeps trying flaky nodes instead of having none to route to
+	MinHealthyNodes 				int
+	// MaxConcurrentPerNode limits the requests a node serves at a time, requests fail over to
+	// nodes with a free slot and wait up to QueueTimeout for one if all nodes are saturated
+	// before failing with ErrNodesSaturated. Zero disables the limit.
+	MaxConcurrentPerNode 			int
+	QueueTimeout 					time.Duration
+	// MaxInFlight limits the requests in flight through Cluster.Do until their response headers
+	// were received, further requests fail with ErrClusterSaturated or, with BlockWhenSaturated,
+	// wait for a request to finish. Zero disables the limit.
+	MaxInFlight 					int
+	BlockWhenSaturated 				bool
+	// RatePerNode limits the requests per second sent to each node, allowing bursts of up to
+	// Burst requests, which defaults to 1. Requests go to nodes with tokens left and wait for the
+	// next token if all nodes are rate limited. Zero disables rate limiting.
+	RatePerNode 					float64
+	Burst 							int
+	// ResolveInterval turns every host into the nodes of the addresses its name resolves to,
+	// which are resolved again at the interval to add and drop nodes as the records change. A
+	// host keeps its last addresses while resolving it fails. Nodes are keyed by address, e.g.
+	// for Weights. Resolution is started when the cluster is created.
+	ResolveInterval 				time.Duration
+	// LookupHost resolves names for ResolveInterval, defaults to net.DefaultResolver
+	LookupHost 						func(ctx context.Context, host string) ([]string, error)
+	// SRVService is the name of SRV records, e.g. "_http._tcp.backend.service.consul", whose
+	// targets become nodes in addition to Hosts. Their priority is used as tier and their weight
+	// for random selection unless the target is listed in Tiers or Weights. The records are
+	// resolved again every ResolveInterval, or DefaultResolveInterval if not set.
+	SRVService 						string
+	// LookupSRV resolves SRVService, defaults to net.DefaultResolver
+	LookupSRV 						func(ctx context.Context, name string) ([]*net.SRV, error)
+	// Credentials authenticate the requests to a host unless they carry an Authorization header
+	// already. They are applied after the Interceptors so those do not see them.
+	Credentials 					map[string]Credentials
+	// DefaultHeaders are added to every request not setting them already, e.g. an Authorization
+	// or User-Agent header
+	DefaultHeaders 					http.Header
+	// Interceptors wrap every attempt of a request on a node, in order from the outermost
+	Interceptors 					[]Interceptor
+	// LatencyDecay is the weight of the latest request in the moving average latency of a node
+	// StrategyLatency balances by, between 0 and 1, defaults to DefaultLatencyDecay
+	LatencyDecay 					float64
+	// DrainTimeout is the time nodes removed from the cluster get to finish their requests in
+	// flight before their idle connections are closed, defaults to DefaultDrainTimeout
+	DrainTimeout 					time.Duration
+	// Balancer overrides Strategy and Weights with a custom node selection
+	Balancer 						Balancer
+	// AttemptTimeout limits the time each attempt may take until the response headers are
+	// received, attempts timing out count as a failure of the node and fail over to the next one
+	AttemptTimeout 					time.Duration
+	// MaxRetries limits the failover attempts after the first one, 0 keeps failing over until
+	// every node was tried and a negative value disables failover. WithRetryPolicy overrides it,
+	// AllowNonIdempotentRetry and the backoff for single requests.
+	MaxRetries 						int
+	// IsNodeDead decides whether a node gets evicted after an attempt, overriding the default
+	// of evicting nodes that are unreachable as reported by IsNodeUnreachable or timed out. It is
+	// not consulted for client errors, a node responding 4xx is never dead.
+	IsNodeDead 						func(resp *http.Response, err error) bool
+	// RetriableStatusCodes are response statuses that get the request retried on another node.
+	// Client errors other than 429 Too Many Requests are never retried.
+	RetriableStatusCodes 			[]int
+	// AllowNonIdempotentRetry permits retrying requests whose method is not idempotent, e.g.
+	// POST or PATCH, on another node after a retriable status or a node failing during the
+	// attempt. Without it such requests only fail over from nodes they cannot have reached.
+	AllowNonIdempotentRetry 		bool
+	// BroadcastEvicts evicts nodes found dead by a Cluster.Broadcast, which by default leaves the
+	// node pool untouched
+	BroadcastEvicts 				bool
+	// HonorRetryAfter stops selecting a node that responded 503 with a Retry-After header for
+	// the duration it asked for
+	HonorRetryAfter 				bool
+	// HedgeAfter sends idempotent requests to a second node as well once the first one did not
+	// respond within the duration, returning whichever response comes first. Zero disables
+	// hedging.
+	HedgeAfter 						time.Duration
+	// Scheme the nodes are addressed with, e.g. "https", by default the scheme of the request
+	// is kept and falls back to "http"
+	Scheme 							string
+	// TLSClientConfig is used by the transports of all nodes, e.g. to trust a custom CA or
+	// present a client certificate. Transport settings are applied when the cluster is created.
+	TLSClientConfig 				*tls.Config
+	// DisableKeepAlives closes the connection to a node after each request instead of reusing it,
+	// it is applied when the cluster is created
+	DisableKeepAlives 				bool
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout tune the idle connections kept alive
+	// like the fields of http.Transport, zero keeps the defaults of http.DefaultTransport. As each
+	// node has a transport of its own they limit the idle connections of every node. They are
+	// applied when the cluster is created.
+	MaxIdleConns 					int
+	MaxIdleConnsPerHost 			int
+	IdleConnTimeout 				time.Duration
+	// DialContext establishes the connections to the nodes instead of a net.Dialer, e.g. to
+	// limit the time dialing may take or bind a source address. Unix socket nodes are dialed
+	// with it as well. It is applied when the cluster is created and not to a transport of
+	// HTTPClient.
+	DialContext 					func(ctx context.Context, network, addr string) (net.Conn, error)
+	// DialTimeout limits the time connecting to a node may take, so nodes whose host is routable
+	// but does not accept connections fail over quickly instead of after the connect timeout of
+	// the OS. It limits DialContext as well and is applied when the cluster is created.
+	DialTimeout 					time.Duration
+	// Proxy returns the proxy requests to the nodes are sent through like http.Transport.Proxy,
+	// by default the proxy of the environment as with http.ProxyFromEnvironment. Unix socket
+	// nodes are never proxied. It is applied when the cluster is created and not to a transport
+	// of HTTPClient.
+	Proxy 							func(*http.Request) (*url.URL, error)
+	// ForceHTTP2 speaks nothing but HTTP/2 to the nodes, negotiated via ALPN over TLS and with
+	// prior knowledge (h2c) over plain TCP. It is applied when the cluster is created and not to
+	// a transport of HTTPClient, which can be any RoundTripper speaking HTTP/2 instead.
+	ForceHTTP2 						bool
+	// HTTPClient is the client all nodes send their requests with, e.g. to set a timeout or a
+	// tuned transport, by default a zero-value client is used. An *http.Transport only serves as
+	// a template: each node gets a clone of it so its connections can be closed on their own, the
+	// transport itself never sends a request and changes to it after the nodes were created do
+	// not reach them. Other RoundTrippers cannot be cloned and are shared by all nodes.
+	HTTPClient 						*http.Client
+	// HealthCheckPath enables active health checks of dead nodes, which are only reanimated once
+	// a GET request for the path responds 200 instead of after NodeReanimationAfterSeconds.
+	// Health checking is started when the cluster is created.
+	HealthCheckPath 				string
+	// HealthCheckInterval between two checks of the dead nodes, defaults to
+	// DefaultHealthCheckInterval
+	HealthCheckInterval 			time.Duration
+	// HealthCheckTimeout of a single check, defaults to the interval
+	HealthCheckTimeout 				time.Duration
+	// FailureThreshold is the number of consecutive failed attempts after which a node is
+	// evicted, requests fail over to other nodes before that as well, defaults to 1
+	FailureThreshold 				int
+	// EventBuffer is the capacity of the channel returned by Cluster.Events, defaults to
+	// DefaultEventBuffer. It is applied when the cluster is created.
+	EventBuffer 					int
+	// OnNodeDead and OnNodeReanimated are called synchronously whenever a node is evicted or
+	// reanimated, from within Do or a background goroutine. They are called without holding any
+	// locks of the cluster but should return quickly, as the request evicting the node waits.
+	// Panics of the callbacks are recovered and logged.
+	OnNodeDead 						func(host string, err error)
+	OnNodeReanimated 				func(host string)
+	// MaxReanimationAttempts removes a node from the cluster for good instead of evicting it once
+	// it died again that many times in a row after being reanimated without serving a request
+	// successfully. OnNodePermanentlyRemoved is called after OnNodeDead for it. Listing the host
+	// again with UpdateWithConfig or AddHost brings back a fresh node.
+	MaxReanimationAttempts 			int
+	OnNodePermanentlyRemoved 		func(host string, err error)
+	// Logger receives log lines about cluster events, nothing is logged by default
+	Logger 							Logger
+	// Tracer traces every attempt to forward a request to a node
+	Tracer 							Tracer
+	// BreakerThreshold enables a circuit breaker per node instead of evicting failing nodes. After
+	// as many consecutive failures the breaker opens and the node is skipped until
+	// BreakerCooldown passed, then a single trial request decides whether it closes again.
+	// Errors and 5xx responses count as failures whether or not the node is considered dead.
+	BreakerThreshold 				int
+	BreakerCooldown 				time.Duration
+	// BackoffBase enables a pause before failing over to another node which doubles with every
+	// failover up to BackoffMax, each pause is randomized between half and all of its length
+	BackoffBase 					time.Duration
+	BackoffMax 						time.Duration
+}
+
+// Delay after which an evicted node is put back into rotation, 0 disables reanimation
+func(config *ClusterConfig) reanimationDelay() time.Duration {
+	if config.NodeReanimationAfter > 0 {
+		return config.NodeReanimationAfter
+	}
+	if config.NodeReanimationAfterSeconds <= 0 {
+		return 0
+	}
+	// Saturate instead of overflowing into a negative duration
+	if config.NodeReanimationAfterSeconds > int64(math.MaxInt64 / time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(config.NodeReanimationAfterSeconds) * time.Second
+}
+
+// Doubles the reanimation delay for each time the node relapsed in a row, up to
+// MaxReanimationAfter. Must be called once per eviction.
+func(config *ClusterConfig) backoffReanimation(node *Node, delay time.Duration) time.Duration {
+	limit := config.MaxReanimationAfter
+	if limit <= 0 || delay <= 0 {
+		return delay
+	}
+	reanimatedAt := node.reanimatedAt.Load()
+	if reanimatedAt == 0 || time.Since(time.Unix(0, reanimatedAt)) >= limit {
+		node.relapses.Store(0)
+		return delay
+	}
+	for relapses := node.relapses.Add(1); relapses > 0 && delay < limit; relapses-- {
+		if delay > limit / 2 {
+			return limit
+		}
+		delay *= 2
+	}
+	return delay
+}
+
+// Spreads the reanimation delay randomly by up to ReanimationJitter of it in either direction
+func(config *ClusterConfig) jitter(delay time.Duration) time.Duration {
+	jitter := math.Min(config.ReanimationJitter, 1)
+	if jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	jittered := float64(delay) * (1 + jitter * (2 * rand.Float64() - 1))
+	if jittered >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(jittered)
+}
+
+// Pause before the given failover, counting from 1
+func(config *ClusterConfig) backoff(failover int) time.Duration {
+	if config.BackoffBase <= 0 || failover <= 0 {
+		return 0
+	}
+	delay := config.BackoffBase
+	for i := 1; i<failover && (config.BackoffMax <= 0 || delay < config.BackoffMax); i++ {
+		if delay > math.MaxInt64 / 2 {
+			break
+		}
+		delay *= 2
+	}
+	if config.BackoffMax > 0 && delay > config.BackoffMax {
+		delay = config.BackoffMax
+	}
+	// Jitter keeps clients that failed at the same time from retrying in lockstep
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Sleeps for the duration unless ctx is done first, in which case its error is returned
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func(config *ClusterConfig) isNodeDead(resp *http.Response, err error) bool {
+	// The node answered, the fault lies with the request
+	if err == nil && isClientError(resp) {
+		return false
+	}
+	if config.IsNodeDead != nil {
+		return config.IsNodeDead(resp, err)
+	}
+	if errors.Is(err, ErrAttemptTimeout) {
+		return true
+	}
+	return IsNodeUnreachable(err)
+}
+
+func isClientError(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500
+}
+
+// Reports whether the request may be sent to another node after the attempt on a dead node
+// failed with err. Requests that never reached the node are always safe to send again.
+func(config *ClusterConfig) mayFailOver(req *http.Request, err error) bool {
+	return config.AllowNonIdempotentRetry || IsIdempotent(req) || IsNodeUnreachable(err)
+}
+
+// Reports whether the response warrants retrying the request on another node
+func(config *ClusterConfig) isRetriable(req *http.Request, resp *http.Response) bool {
+	if !config.AllowNonIdempotentRetry && !IsIdempotent(req) {
+		return false
+	}
+	// Another node would reject the request just the same, retrying would only mask the bug of
+	// the client
+	if isClientError(resp) && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	for _, statusCode := range config.RetriableStatusCodes {
+		if resp.StatusCode == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func(config *ClusterConfig) NewBalancer() Balancer {
+	if config.Balancer != nil {
+		return config.Balancer
+	}
+	switch config.Strategy {
+	case StrategyRoundRobin:
+		return &RoundRobinBalancer{}
+	case StrategyLeastConnections:
+		return &LeastConnectionsBalancer{}
+	case StrategyConsistentHash:
+		return &ConsistentHashBalancer{HashKey: config.HashKey}
+	case StrategyPowerOfTwoChoices:
+		return &PowerOfTwoChoicesBalancer{}
+	case StrategyLatency:
+		return &LatencyBalancer{}
+	case StrategyStickySession:
+		return &StickySessionBalancer{SessionKey: config.SessionKey, TTL: config.SessionTTL,
+			Balancer: &RandomBalancer{Weights: config.Weights, srvWeights: config.SRVService != ""}}
+	default:
+		return &RandomBalancer{Weights: config.Weights, srvWeights: config.SRVService != ""}
+	}
 }
 
 func(config *ClusterConfig) UnsupportedNodes(nodes []*Node) []*Node {
@@ -45,17 +444,81 @@ func(config *ClusterConfig) SupportedNodesMissing(nodes []*Node) []*Node {
 			}
 		}
 		if !found {
-			supportedNodesMissing = append(supportedNodesMissing, NewNode(host))
+			supportedNodesMissing = append(supportedNodesMissing, config.newNode(host))
 		}
 	}
 	return supportedNodesMissing
 }
 
+// Validate reports the first malformed setting of the config
+func(config *ClusterConfig) Validate() error {
+	if len(config.Hosts) == 0 && config.SRVService == "" {
+		return ErrNoHosts
+	}
+	for _, host := range config.Hosts {
+		if err := ValidateHost(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateHost checks that the host is given in host:port form, e.g. "localhost:8080", with
+// IPv6 literals in brackets, e.g. "[::1]:8080". The port has to be numeric, whether it is in
+// range is left to dialing it.
+func ValidateHost(host string) error {
+	if host == "" {
+		return errors.New("Invalid host: host is empty")
+	}
+	if path, ok := unixSocket(host); ok {
+		if path == "" {
+			return fmt.Errorf("Invalid host %q: missing socket path", host)
+		}
+		return nil
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return fmt.Errorf("Invalid host %q: %v", host, err)
+	}
+	if hostname == "" {
+		return fmt.Errorf("Invalid host %q: missing host name", host)
+	}
+	// Brackets are reserved for IPv6 literals, which in turn have to be bracketed to be told
+	// apart from the port
+	bracketed := strings.HasPrefix(host, "[")
+	isIPv6 := strings.Contains(hostname, ":")
+	if bracketed && (!isIPv6 || net.ParseIP(strings.SplitN(hostname, "%", 2)[0]) == nil) {
+		return fmt.Errorf("Invalid host %q: only IPv6 addresses may be bracketed", host)
+	}
+	if port == "" {
+		return fmt.Errorf("Invalid host %q: missing port", host)
+	}
+	for _, char := range port {
+		if char < '0' || char > '9' {
+			return fmt.Errorf("Invalid host %q: port %q is not numeric", host, port)
+		}
+	}
+	return nil
+}
+
+// Creates a node for the host set up according to the config
+func(config *ClusterConfig) newNode(host string) *Node {
+	node := NewNode(host)
+	scheme := config.Scheme
+	node.scheme.Store(&scheme)
+	node.latencyDecay.Store(math.Float64bits(config.latencyDecay()))
+	node.credentials.Store(config.credentials(host))
+	return node
+}
+
+// Returns the nodes without the node for the host of nodeToRemove. The given slice is never
+// modified in place, so snapshots of it taken under a lock remain valid after the lock is released.
 func RemoveNode(nodes []*Node, nodeToRemove *Node) []*Node {
 	for idx, node := range nodes {
-		if node == nodeToRemove {
-			nodes = append(nodes[:idx], nodes[idx+1:] ...)
-			break
+		if node.Host == nodeToRemove.Host {
+			remaining := make([]*Node, 0, len(nodes)-1)
+			remaining = append(remaining, nodes[:idx] ...)
+			return append(remaining, nodes[idx+1:] ...)
 		}
 	}
 	return nodes
@@ -68,11 +531,14 @@ func AddNodes(nodes, nodesToAdd []*Node) []*Node {
 	return nodes
 }
 
+// Appends nodeToAdd unless the nodes contain a node for its host already. Nodes are identified
+// by their host, as different *Node values may be created for the same host.
 func AddNode(nodes []*Node, nodeToAdd *Node) []*Node {
 	found := false
 	for _, node := range nodes {
-		if nodeToAdd == node {
+		if node.Host == nodeToAdd.Host {
 			found = true
+			break
 		}
 	}
 	if !found {
@@ -84,97 +550,1012 @@ func AddNode(nodes []*Node, nodeToAdd *Node) []*Node {
 type Node struct {
 	Client 	*http.Client
 	Host 	string
+	// Scheme of a node used on its own, the nodes of a cluster follow ClusterConfig.Scheme
+	Scheme 	string
+	// Scheme of the cluster config, updated with it
+	scheme 		atomic.Pointer[string]
+	inFlight 	atomic.Int64
+	consecutiveFailures 	atomic.Int64
+	breaker 	breaker
+	stats 		nodeStats
+	state 		atomic.Int32
+	// Unix nanoseconds of the last reanimation, the start of the slow-start ramp
+	reanimatedAt 	atomic.Int64
+	// Evictions in a row that followed a reanimation within MaxReanimationAfter
+	relapses 		atomic.Int64
+	// Unix nanoseconds before which health checks do not probe the dead node
+	probeAfter 		atomic.Int64
+	// Whether the node was reanimated and did not serve a request successfully since, and the
+	// reanimations in a row it failed like that
+	probation 			atomic.Bool
+	failedReanimations 	atomic.Int64
+	outliers 	outlierWindow
+	// Requests holding one of the MaxConcurrentPerNode slots of the node
+	slots 		atomic.Int64
+	bucket 		tokenBucket
+	// Whether the node was discovered via an SRV record and the record's priority and weight
+	srv 			atomic.Bool
+	srvPriority 	atomic.Int64
+	srvWeight 		atomic.Int64
+	// Moving average latency in nanoseconds and the weight of new samples, as float64 bits
+	latency 		atomic.Uint64
+	latencyDecay 	atomic.Uint64
+	// Unix nanoseconds since which the latency has exceeded MaxLatency, zero while it does not
+	slowSince 		atomic.Int64
+	// Credentials of the host from ClusterConfig.Credentials, nil without
+	credentials 	atomic.Pointer[Credentials]
+	// Unix nanoseconds until which the node is not selected as it asked via Retry-After
+	suspendedUntil 	atomic.Int64
+	// Stops the pending timed reanimation of a dead node, guarded by the cluster's DeadPoolMutex
+	cancelReanimation 	context.CancelFunc
+}
+
+// State of the node's circuit breaker, always BreakerClosed unless breakers are configured
+func(node *Node) BreakerState() BreakerState {
+	return node.breaker.currentState()
+}
+
+// Number of requests currently being processed by the node
+func(node *Node) InFlight() int64 {
+	return node.inFlight.Load()
 }
 
 func(node *Node) Do(req *http.Request) (resp *http.Response, err error) {
-	// Set the scheme and host of the request
-	req.URL.Scheme = "http"
-	req.URL.Host = node.Host
-	// Verify the request header contains the keep-alive directive to keep up the connection for 
-	// re-use where possible
-	if req.Header == nil {
-		req.Header = map[string][]string{}
-	}
-	req.Header["Connection"] = []string{"keep-alive"}
-	resp, err = node.Client.Do(req)
+	node.inFlight.Add(1)
+	defer node.inFlight.Add(-1)
+	started := time.Now()
+	defer func() {
+		node.observeLatency(time.Since(started))
+	}()
+	// Address a copy of the request to the node, the caller's request is left untouched and can
+	// be sent again. Only the URL is modified, the header is shared as the client does not
+	// modify it.
+	nodeReq := *req
+	nodeURL := *req.URL
+	nodeReq.URL = &nodeURL
+	scheme := node.Scheme
+	if configured := node.scheme.Load(); configured != nil {
+		scheme = *configured
+	}
+	switch {
+	case scheme != "":
+		nodeURL.Scheme = scheme
+	case nodeURL.Scheme == "":
+		nodeURL.Scheme = "http"
+	}
+	nodeURL.Host = node.Host
+	if _, ok := unixSocket(node.Host); ok {
+		// The transport of the node dials the socket, the request only needs a valid host
+		nodeURL.Host = unixPlaceholderHost
+	}
+	// The transport refuses requests without a header, connections are kept alive by the
+	// transport unless ClusterConfig.DisableKeepAlives is set
+	if nodeReq.Header == nil {
+		nodeReq.Header = map[string][]string{}
+	}
+	resp, err = node.Client.Do(withCredentials(&nodeReq, node.credentials.Load()))
 	return
 }
 
 func NewNode(host string) *Node {
-	return &Node{Host: host, Client: &http.Client{}}
+	client := &http.Client{}
+	if path, ok := unixSocket(host); ok {
+		client.Transport = unixTransport(nil, path)
+	}
+	return &Node{Host: host, Client: client}
 }
 
 type Cluster struct {
 	http.Client
-	Config 			ClusterConfig
+	// Nodes and DeadPool can be read under their mutexes. Requests read a snapshot published on
+	// every change instead, so changes have to be made through AddHost, RemoveHost and
+	// UpdateWithConfig. The config is read with CurrentConfig.
+	config 			ClusterConfig
 	Nodes 			[]*Node
 	NodesMutex 		*sync.RWMutex
 	DeadPool 		[]*Node
 	DeadPoolMutex	*sync.RWMutex
 	NodeReanimationAfterSeconds int64
+	balancer 		Balancer
+	// Cancelled by Close to stop the background goroutines tracked by background
+	ctx 			context.Context
+	cancel 			context.CancelFunc
+	background 		sync.WaitGroup
+	backgroundMutex sync.Mutex
+	// Addresses each configured host resolved to and the records of SRVService, guarded by
+	// NodesMutex
+	resolved 		map[string][]string
+	srvRecords 		[]*net.SRV
+	// Serializes UpdateWithConfig and the resolver, so addresses resolved for one config are
+	// never reconciled with another
+	updateMutex 	sync.Mutex
+	// Published for requests to read without locking
+	state 			atomic.Pointer[clusterState]
+	// Closed and replaced whenever a node frees a concurrency slot
+	slotFreed 		chan struct{}
+	slotMutex 		sync.Mutex
+	// Requests in flight limited by MaxInFlight
+	inFlight 		semaphore
+	metrics 		clusterMetrics
+	// Transitions of the nodes delivered by Events
+	events 			chan NodeEvent
+	droppedEvents 	atomic.Int64
+}
+
+var ErrClusterClosed = errors.New("Cluster is closed")
+
+// Returned by NewCluster for a config without hosts, as opposed to ErrNoNodesAvailable once all
+// nodes of a cluster died
+var ErrNoHosts = errors.New("Cluster config lists no hosts")
+
+// Runs f in a goroutine tracked for Close, f must return once ctx is done. Returns false
+// without running f if the cluster is already closed.
+func(cluster *Cluster) goBackground(f func(ctx context.Context)) bool {
+	cluster.backgroundMutex.Lock()
+	defer cluster.backgroundMutex.Unlock()
+	if cluster.ctx.Err() != nil {
+		return false
+	}
+	cluster.background.Add(1)
+	go func() {
+		defer cluster.background.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				cluster.NodesMutex.RLock()
+				config := cluster.config
+				cluster.NodesMutex.RUnlock()
+				config.recovered("background goroutine", r)
+			}
+		}()
+		f(cluster.ctx)
+	}()
+	return true
 }
 
+// Close stops pending reanimations and health checks and waits for them to exit. Requests sent
+// through the cluster after Close fail with ErrClusterClosed.
+func(cluster *Cluster) Close() {
+	cluster.backgroundMutex.Lock()
+	cluster.cancel()
+	cluster.backgroundMutex.Unlock()
+	cluster.background.Wait()
+}
+
+// Patterns with regexp syntax compiled by MatchString, keyed by pattern
+var compiledPatterns sync.Map
+
+// Characters with a special meaning in regexp patterns, patterns without any are literal
+const regexpSpecialChars = `\.+*?()|[]{}^$`
+
+// Reports whether str contains a match of the pattern. Literal patterns like "connection
+// refused" are matched as plain substrings without involving regexp, other patterns are
+// compiled only once. An invalid pattern matches nothing.
+//
+// Deprecated: the cluster no longer matches error messages against patterns, dead nodes are
+// detected by the error types checked in IsNodeUnreachable.
 func MatchString(pattern, str string) bool {
-	matched, _ := regexp.MatchString(pattern, str)
-	return matched
+	if !strings.ContainsAny(pattern, regexpSpecialChars) {
+		return strings.Contains(str, pattern)
+	}
+	compiled, ok := compiledPatterns.Load(pattern)
+	if !ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false
+		}
+		compiled, _ = compiledPatterns.LoadOrStore(pattern, re)
+	}
+	return compiled.(*regexp.Regexp).MatchString(str)
 }
 
-func(cluster *Cluster) Do(req *http.Request) (resp *http.Response, err error) {
-	if len(cluster.Nodes) == 0 {
-		err = errors.New("No cluster nodes available")
-		return
+// Reports whether err shows that the node could not be reached at all, e.g. a refused
+// connection, an unreachable host, an address that cannot be dialed, or a dial exceeding
+// DialTimeout. Errors returned by a reachable node are not considered.
+func IsNodeUnreachable(err error) bool {
+	if err == nil {
+		return false
 	}
-	cluster.NodesMutex.Lock()
-	rand.Seed(time.Now().UnixNano())
-    idx := rand.Intn(len(cluster.Nodes))
-	node := cluster.Nodes[idx]
-	cluster.NodesMutex.Unlock()
-	resp, err = node.Do(req)
-	errMsg := fmt.Sprintf("%v", err)
-	if MatchString("connection refused", errMsg) || MatchString("no route to host", errMsg) || MatchString("invalid port", errMsg) {
+	if errors.Is(err, ErrDialTimeout) {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.ENOENT:
+			return true
+		}
+	}
+	var addrErr *net.AddrError
+	if errors.As(err, &addrErr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// Asks the balancer for the next node out of the given live nodes not skipped the request is
+// routed to and only accepts one of those
+func(config *ClusterConfig) selectNode(nodes []*Node, balancer Balancer, req *http.Request, skip func(*Node) bool) *Node {
+	// The nodes may be a snapshot taken before a concurrent eviction, nodes known to be dead are
+	// skipped rather than waiting for another failed connection
+	excluded := func(node *Node) bool {
+		state := node.State()
+		return state == NodeDead || state == NodeDraining || state == NodeRemoved ||
+			(skip != nil && skip(node)) || (config.HonorRetryAfter && node.suspended())
+	}
+	candidates := nodes
+	for idx, node := range nodes {
+		if excluded(node) {
+			// Only copied once a node has to be left out
+			candidates = append(make([]*Node, 0, len(nodes)), nodes[:idx] ...)
+			for _, node := range nodes[idx+1:] {
+				if !excluded(node) {
+					candidates = append(candidates, node)
+				}
+			}
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = config.route(candidates, req)
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = config.thinSuspects(candidates)
+	candidates = config.slowStart(candidates)
+	if selector := requestSelector(req); selector != nil {
+		if node := selector(candidates); containsNode(candidates, node) {
+			return node
+		}
+	}
+	node := balancer.Pick(candidates, req)
+	if !containsNode(candidates, node) {
+		return nil
+	}
+	return node
+}
+
+// Moves the node to the dead pool and schedules its reanimation if configured. With active
+// health checks the node stays dead until it passes a check. Nodes no longer live, e.g. because
+// a concurrent request evicted them already, are left alone.
+func(cluster *Cluster) evict(node *Node, err error) bool {
+	return cluster.evictCapped(node, err, 1)
+}
+
+// Evicts the node unless the given fraction of all nodes is dead already
+func(cluster *Cluster) evictCapped(node *Node, err error, maxDead float64) bool {
+	var config ClusterConfig
+	var evicted, kept, removed bool
+	var reanimationCtx context.Context
+	var reanimationDelay time.Duration
+	// The locks are released by defers so a panic cannot leave them held
+	func() {
 		cluster.NodesMutex.Lock()
-		cluster.Nodes = RemoveNode(cluster.Nodes, node)
-		cluster.NodesMutex.Unlock()
+		defer cluster.NodesMutex.Unlock()
 		cluster.DeadPoolMutex.Lock()
-		cluster.DeadPool = AddNode(cluster.DeadPool, node)
-		cluster.DeadPoolMutex.Unlock()
-		if cluster.NodeReanimationAfterSeconds > 0 {
-			go func(){
-				time.Sleep(time.Duration(cluster.NodeReanimationAfterSeconds * 1000 * 1000 * 1000))
-				cluster.DeadPoolMutex.Lock()
-				cluster.DeadPool = RemoveNode(cluster.DeadPool, node)
-				cluster.DeadPoolMutex.Unlock()
-				cluster.NodesMutex.Lock()
-				cluster.Nodes = AddNode(cluster.Nodes, node)
-				cluster.NodesMutex.Unlock()
-			}()
-		}
-		resp, err = cluster.Do(req)
+		defer cluster.DeadPoolMutex.Unlock()
+		config = cluster.config
+		evicted = containsNode(cluster.Nodes, node)
+		if maxDead < 1 && float64(len(cluster.DeadPool)) >= maxDead * float64(len(cluster.Nodes) + len(cluster.DeadPool)) {
+			evicted = false
+		}
+		// A degraded cluster keeps routing to flaky nodes rather than having none left
+		kept = evicted && len(cluster.Nodes) <= config.MinHealthyNodes
+		evicted = evicted && !kept
+		if evicted && node.probation.Swap(false) {
+			failed := node.failedReanimations.Add(1)
+			removed = config.MaxReanimationAttempts > 0 && failed >= int64(config.MaxReanimationAttempts)
+		}
+		if removed {
+			// The node is given up on, only listing its host again brings it back
+			cluster.Nodes = RemoveNode(cluster.Nodes, node)
+			cluster.config.Hosts = withoutHost(cluster.config.Hosts, node.Host)
+			cluster.publish()
+			node.setState(NodeRemoved)
+		} else if evicted {
+			cluster.Nodes = RemoveNode(cluster.Nodes, node)
+			cluster.DeadPool = AddNode(cluster.DeadPool, node)
+			cluster.publish()
+			node.setState(NodeDead)
+			if config.HealthCheckPath != "" {
+				// Health checks start from their interval and hold off probing a relapsing node
+				// for the time it was backed off by on top of that
+				interval := config.healthCheckInterval()
+				holdOff := config.jitter(config.backoffReanimation(node, interval) - interval)
+				node.probeAfter.Store(time.Now().Add(holdOff).UnixNano())
+			} else {
+				reanimationDelay = config.jitter(config.backoffReanimation(node, config.nodeReanimationDelay(node)))
+			}
+			if reanimationDelay > 0 {
+				reanimationCtx, node.cancelReanimation = context.WithCancel(cluster.ctx)
+			}
+		}
+	}()
+	if kept {
+		config.logger().Printf("Cluster kept node %s to stay at %d live nodes: %v", node.Host, config.MinHealthyNodes, err)
+	}
+	if !evicted {
+		return false
+	}
+	cluster.metrics.evictions.Add(1)
+	config.logger().Printf("Cluster evicted node %s: %v", node.Host, err)
+	// Pooled connections to the dead node would fail the first requests after its reanimation
+	cluster.closeIdleConnections(node)
+	config.notifyNodeDead(node.Host, err)
+	cluster.emit(EventNodeDead, node.Host, err)
+	if removed {
+		config.logger().Printf("Cluster removed node %s after %d failed reanimations", node.Host, node.failedReanimations.Load())
+		config.notifyNodePermanentlyRemoved(node.Host, err)
+		cluster.emit(EventNodeRemoved, node.Host, err)
 	}
+	if reanimationCtx != nil {
+		cluster.goBackground(func(ctx context.Context) {
+			timer := time.NewTimer(reanimationDelay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				cluster.reanimate(node)
+			case <-reanimationCtx.Done():
+			}
+		})
+	}
+	return true
+}
+
+// Stops the pending reanimation of the node, if any, must be called with DeadPoolMutex held
+func cancelReanimation(node *Node) {
+	if node.cancelReanimation != nil {
+		node.cancelReanimation()
+		node.cancelReanimation = nil
+	}
+}
+
+// Moves the node from the dead pool back to the live nodes, nodes no longer in the dead pool,
+// e.g. because they were removed from the cluster meanwhile, are left alone
+func(cluster *Cluster) reanimate(node *Node) bool {
+	var config ClusterConfig
+	var reanimated bool
+	// The locks are released by defers so a panic cannot leave them held
+	func() {
+		cluster.NodesMutex.Lock()
+		defer cluster.NodesMutex.Unlock()
+		cluster.DeadPoolMutex.Lock()
+		defer cluster.DeadPoolMutex.Unlock()
+		reanimated = containsNode(cluster.DeadPool, node)
+		if reanimated {
+			cluster.DeadPool = RemoveNode(cluster.DeadPool, node)
+			cluster.Nodes = AddNode(cluster.Nodes, node)
+			cluster.publish()
+			node.setState(NodeSuspect)
+			node.reanimatedAt.Store(time.Now().UnixNano())
+			node.probation.Store(true)
+			cancelReanimation(node)
+		}
+		config = cluster.config
+	}()
+	if !reanimated {
+		return false
+	}
+	cluster.metrics.reanimations.Add(1)
+	config.logger().Printf("Cluster reanimated node %s", node.Host)
+	config.notifyNodeReanimated(node.Host)
+	cluster.emit(EventNodeReanimated, node.Host, nil)
+	return true
+}
+
+// Returns the hosts without duplicates, keeping the first occurrence of each
+func uniqueHosts(hosts []string) []string {
+	seen := make(map[string]bool, len(hosts))
+	unique := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+func findNode(nodes []*Node, host string) *Node {
+	for _, node := range nodes {
+		if node.Host == host {
+			return node
+		}
+	}
+	return nil
+}
+
+func containsNode(nodes []*Node, node *Node) bool {
+	for _, candidate := range nodes {
+		if candidate == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether repeating the request has the same effect as sending it once
+func IsIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+var ErrBodyNotReplayable = errors.New("Request body cannot be replayed on another node")
+
+// Returns a copy of the request with a fresh body for another attempt. Bodies are replayed
+// through req.GetBody, which http.NewRequest provides for in-memory bodies, streaming bodies
+// without it cannot be sent twice.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, ErrBodyNotReplayable
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retryReq := *req
+	retryReq.Body = body
+	return &retryReq, nil
+}
+
+// Drains and closes a response that is not handed back to the caller so its connection can be
+// reused
+func discardResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Joins the error of an expired context with the errors of the failed attempts, if any
+func contextError(ctxErr error, attempts []NodeAttempt) error {
+	if len(attempts) == 0 {
+		return ctxErr
+	}
+	return errors.Join(ctxErr, attemptsError(attempts))
+}
+
+// Do forwards the request to one of the live nodes. Nodes found dead are evicted and the request
+// fails over to another live node, each node being attempted at most once per call so the number
+// of attempts is bounded by the number of nodes.
+func(cluster *Cluster) Do(req *http.Request) (resp *http.Response, err error) {
+	return cluster.DoContext(req.Context(), req)
+}
+
+// DoContext forwards the request to one of the cluster nodes, failing over to other nodes as
+// long as ctx permits. The deadline of ctx applies to the whole sequence of attempts.
+func(cluster *Cluster) DoContext(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	if req.Context() != ctx {
+		req = req.WithContext(ctx)
+	}
+	resp, _, err = cluster.do(req)
 	return
 }
 
+// DoWithNode works like Do and additionally returns the node that served the response
+func(cluster *Cluster) DoWithNode(req *http.Request) (resp *http.Response, node *Node, err error) {
+	return cluster.do(req)
+}
+
+func(cluster *Cluster) do(req *http.Request) (resp *http.Response, served *Node, err error) {
+	cluster.metrics.requests.Add(1)
+	defer func() {
+		if err != nil {
+			cluster.metrics.failures.Add(1)
+		}
+	}()
+	if cluster.ctx.Err() != nil {
+		err = ErrClusterClosed
+		return
+	}
+	current := cluster.snapshot().config
+	maxInFlight, blockWhenSaturated := current.MaxInFlight, current.BlockWhenSaturated
+	if maxInFlight > 0 {
+		if blockWhenSaturated {
+			if err = cluster.inFlight.acquire(req.Context(), maxInFlight); err != nil {
+				return
+			}
+		} else if !cluster.inFlight.tryAcquire(maxInFlight) {
+			err = ErrClusterSaturated
+			return
+		}
+		defer cluster.inFlight.release()
+	}
+	// A response with a retriable status is held back until another node is found to retry on
+	var lastResp *http.Response
+	var lastRespNode *Node
+	// Nodes attempted during this call are not picked again, even if a concurrent reanimation
+	// brings them back while we are still failing over
+	tried := map[*Node]bool{}
+	var attempts []NodeAttempt
+	// Hosts the request was sent to, handed to the caller with the response
+	var triedHosts []string
+	defer func() {
+		withAttemptInfo(resp, triedHosts)
+	}()
+	policy, hasPolicy := requestRetryPolicy(req)
+	// Number of failovers so far and whether the next attempt is one
+	failovers, failingOver := 0, false
+	// Until when the request may wait for saturated nodes to free a slot
+	var queueDeadline time.Time
+	for attempt := 0; ; attempt++ {
+		// Do not start another attempt on behalf of a caller that already gave up
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			discardResponse(lastResp)
+			err = contextError(ctxErr, attempts)
+			return
+		}
+		// Select from the published snapshot without locking, evictions and config updates
+		// publish a new node slice rather than modifying it
+		state := cluster.snapshot()
+		nodes, balancer, config := state.nodes, state.balancer, state.config
+		if hasPolicy {
+			config = config.withRetryPolicy(policy)
+		}
+		breakers := config.BreakerThreshold > 0
+		limit := config.MaxConcurrentPerNode
+		var unavailable, skip func(*Node) bool
+		if len(tried) > 0 || breakers {
+			unavailable = func(node *Node) bool {
+				return tried[node] || (breakers && !node.breaker.available(config.BreakerCooldown))
+			}
+			skip = unavailable
+		}
+		if limit > 0 || config.RatePerNode > 0 {
+			skip = func(node *Node) bool {
+				return (unavailable != nil && unavailable(node)) || node.saturated(limit) || config.rateLimited(node)
+			}
+		}
+		node := config.selectNode(nodes, balancer, req, skip)
+		if node == nil && config.RatePerNode > 0 {
+			// Wait for the next token rather than failing while nodes are merely rate limited
+			if wait, limited := config.nextToken(nodes, unavailable); limited {
+				if ctxErr := sleepContext(req.Context(), wait); ctxErr != nil {
+					discardResponse(lastResp)
+					err = contextError(ctxErr, attempts)
+					return
+				}
+				attempt--
+				continue
+			}
+		}
+		if node == nil && limit > 0 {
+			if queueDeadline.IsZero() {
+				queueDeadline = time.Now().Add(config.QueueTimeout)
+			}
+			queued, waitErr := cluster.waitForSlot(req.Context(), nodes, unavailable, limit, queueDeadline)
+			switch {
+			case queued:
+				// Selection starts over without counting as an attempt
+				attempt--
+				continue
+			case waitErr == ErrNodesSaturated && lastResp == nil:
+				err = ErrNodesSaturated
+				config.logger().Printf("Cluster has no node with a free slot for %s %s", req.Method, req.URL.Path)
+				return
+			case waitErr != nil && waitErr != ErrNodesSaturated:
+				discardResponse(lastResp)
+				err = contextError(waitErr, attempts)
+				return
+			}
+		}
+		if node == nil {
+			if lastResp != nil {
+				resp, served = lastResp, lastRespNode
+				return
+			}
+			err = &AllNodesUnavailableError{Attempts: attempts}
+			config.logger().Printf("Cluster has no node left for %s %s after %d attempts", req.Method, req.URL.Path, len(attempts))
+			return
+		}
+		if failingOver {
+			failingOver = false
+			if ctxErr := sleepContext(req.Context(), config.backoff(failovers)); ctxErr != nil {
+				discardResponse(lastResp)
+				err = contextError(ctxErr, attempts)
+				return
+			}
+		}
+		attemptReq := req
+		if attempt > 0 {
+			if attemptReq, err = rewindBody(req); err != nil {
+				discardResponse(lastResp)
+				err = errors.Join(err, attemptsError(attempts))
+				return
+			}
+		}
+		// Another request may have taken the last slot or token of the node since the selection
+		if limit > 0 && !node.acquireSlot(limit) {
+			attempt--
+			continue
+		}
+		if !config.takeToken(node) {
+			if limit > 0 {
+				cluster.releaseSlot(node)
+			}
+			attempt--
+			continue
+		}
+		tried[node] = true
+		// Formatting arguments allocate even for a discarding logger, skip them on the hot path
+		if config.Logger != nil {
+			config.Logger.Printf("Cluster selected node %s for %s %s (attempt %d)", node.Host, req.Method, req.URL.Path, attempt+1)
+		}
+		// Another request may have taken the trial of a half-open breaker since the selection
+		if breakers && !node.breaker.acquire(config.BreakerCooldown) {
+			if limit > 0 {
+				cluster.releaseSlot(node)
+			}
+			// The node is skipped without sending the request, which does not use up a retry
+			attempt--
+			continue
+		}
+		triedHosts = append(triedHosts, node.Host)
+		discardResponse(lastResp)
+		lastResp, lastRespNode = nil, nil
+		attemptReq = config.withDefaultHeaders(attemptReq)
+		attemptReq, span := config.startAttempt(attemptReq, node.Host, attempt+1)
+		attemptReq, finishAttempt := config.withAttemptTimeout(attemptReq)
+		started := time.Now()
+		slotNode := node
+		if config.HedgeAfter > 0 && IsIdempotent(req) {
+			// The hedge takes a slot and token of its node like any attempt
+			pickHedge := func() *Node {
+				hedgeNode := config.selectNode(nodes, balancer, req, func(node *Node) bool {
+					return tried[node] || (breakers && !node.breaker.available(config.BreakerCooldown)) ||
+						node.saturated(limit) || config.rateLimited(node)
+				})
+				if hedgeNode == nil || (limit > 0 && !hedgeNode.acquireSlot(limit)) {
+					return nil
+				}
+				if !config.takeToken(hedgeNode) || (breakers && !hedgeNode.breaker.acquire(config.BreakerCooldown)) {
+					if limit > 0 {
+						cluster.releaseSlot(hedgeNode)
+					}
+					return nil
+				}
+				return hedgeNode
+			}
+			hedged := func(hedgeNode *Node) {
+				tried[hedgeNode] = true
+				triedHosts = append(triedHosts, hedgeNode.Host)
+				config.logger().Printf("Cluster hedging %s %s on node %s", req.Method, req.URL.Path, hedgeNode.Host)
+			}
+			// The slots are released as the results of the nodes arrive
+			release := func(node *Node) {
+				if limit > 0 {
+					cluster.releaseSlot(node)
+				}
+			}
+			slotNode = nil
+			resp, node, err = config.hedge(attemptReq, node, pickHedge, hedged, release)
+		} else {
+			resp, err = config.doNode(node, attemptReq)
+		}
+		resp, err = finishAttempt(resp, err)
+		if limit > 0 && slotNode != nil {
+			cluster.releaseSlot(slotNode)
+		}
+		node.stats.record(time.Since(started))
+		config.observeRetryAfter(node, resp)
+		if req.Context().Err() == nil {
+			cluster.detectOutlier(config, node, resp, err)
+		}
+		if err != nil && req.Context().Err() != nil {
+			// The caller cancelled the request, which says nothing about the health of the node
+			if breakers {
+				node.breaker.release()
+			}
+			span.End(err, false)
+			err = contextError(req.Context().Err(), attempts)
+			return
+		}
+		exhausted := config.MaxRetries < 0 || (config.MaxRetries > 0 && attempt >= config.MaxRetries)
+		if config.isNodeDead(resp, err) {
+			// The node may have processed the request before failing, so a non-idempotent request
+			// is only sent to another node if it cannot have reached this one
+			exhausted = exhausted || !config.mayFailOver(req, err)
+			lastErr := cluster.nodeFailed(config, node, resp, err)
+			attempts = append(attempts, NodeAttempt{Host: node.Host, Err: lastErr})
+			span.End(lastErr, !exhausted)
+			if exhausted {
+				if resp != nil {
+					served = node
+				} else if len(attempts) > 1 {
+					err = attemptsError(attempts)
+				}
+				return
+			}
+			// The response of the dead node is discarded in favour of the next attempt
+			discardResponse(resp)
+			resp = nil
+			failovers, failingOver = failovers+1, true
+			continue
+		}
+		if err == nil && resp.StatusCode < 500 {
+			nodeSucceeded(config, node)
+		} else {
+			nodeErred(config, node)
+		}
+		cluster.checkLatency(config, node)
+		if err == nil && config.isRetriable(req, resp) && !exhausted {
+			lastErr := fmt.Errorf("Node %s responded %s", node.Host, resp.Status)
+			attempts = append(attempts, NodeAttempt{Host: node.Host, Err: lastErr})
+			span.End(lastErr, true)
+			lastResp, lastRespNode = resp, node
+			resp = nil
+			failovers, failingOver = failovers+1, true
+			continue
+		}
+		span.End(err, false)
+		if resp != nil {
+			served = node
+		}
+		return
+	}
+}
+
+// Records a failed attempt of a node found dead, opening its breaker or evicting it once it
+// failed often enough, and returns the error the attempt failed with
+func(cluster *Cluster) nodeFailed(config *ClusterConfig, node *Node, resp *http.Response, err error) error {
+	node.stats.failures.Add(1)
+	if err == nil {
+		err = fmt.Errorf("Node %s considered dead after responding %s", node.Host, resp.Status)
+	}
+	cluster.countFailure(config, node, err)
+	return err
+}
+
+// Counts a failure towards evicting the node once FailureThreshold consecutive ones are reached,
+// or towards opening its breaker if breakers are enabled
+func(cluster *Cluster) countFailure(config *ClusterConfig, node *Node, err error) {
+	node.state.CompareAndSwap(int32(NodeHealthy), int32(NodeSuspect))
+	if config.BreakerThreshold > 0 {
+		node.breaker.failure(config.BreakerThreshold)
+	} else if node.consecutiveFailures.Add(1) >= int64(config.FailureThreshold) {
+		// A reanimated node starts over with a clean record
+		node.consecutiveFailures.Store(0)
+		cluster.evict(node, err)
+	}
+}
+
+// Records an attempt the node answered with an error or a 5xx response without being
+// considered dead for it
+func nodeErred(config *ClusterConfig, node *Node) {
+	node.stats.failures.Add(1)
+	if config.BreakerThreshold > 0 {
+		node.breaker.failure(config.BreakerThreshold)
+	}
+}
+
+func nodeSucceeded(config *ClusterConfig, node *Node) {
+	node.stats.successes.Add(1)
+	node.consecutiveFailures.Store(0)
+	node.state.CompareAndSwap(int32(NodeSuspect), int32(NodeHealthy))
+	if node.probation.Load() && node.probation.Swap(false) {
+		node.failedReanimations.Store(0)
+	}
+	if config.BreakerThreshold > 0 {
+		node.breaker.success()
+	}
+}
+
+// UpdateWithConfig reconciles the cluster with the config. Nodes are matched by host, so nodes
+// of hosts that remain keep their connections, stats and state, while nodes are only created for
+// new hosts and dropped for hosts no longer listed.
 func(cluster *Cluster) UpdateWithConfig(config *ClusterConfig) {
+	cluster.updateMutex.Lock()
+	defer cluster.updateMutex.Unlock()
 	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
 	cluster.DeadPoolMutex.Lock()
-	// Remove any non-supported nodes from the cluster
-	allNodes := append(cluster.DeadPool, cluster.Nodes ...)
-	for _, node := range config.UnsupportedNodes(allNodes) {
-		cluster.DeadPool = RemoveNode(cluster.DeadPool, node)
-		cluster.Nodes = RemoveNode(cluster.Nodes, node)
+	defer cluster.DeadPoolMutex.Unlock()
+	hosts := uniqueHosts(config.Hosts)
+	nodeHosts := hosts
+	if config.resolving() {
+		nodeHosts = cluster.resolvedHosts(config, hosts)
 	}
-	// Add any newly supported node to the cluster
-	cluster.Nodes = AddNodes(cluster.Nodes, config.SupportedNodesMissing(allNodes))
-	cluster.DeadPoolMutex.Unlock()
-	cluster.NodesMutex.Unlock()
+	cluster.reconcile(config, nodeHosts)
+	cluster.applySRV()
+	// The caller keeps its config, later changes to it must not reach the cluster
+	cluster.config = *config.clone()
+	cluster.config.Hosts = hosts
+	cluster.renewBalancer(config)
 	cluster.NodeReanimationAfterSeconds = config.NodeReanimationAfterSeconds
+	cluster.publish()
+}
+
+// Replaces the balancer with a new one for the config, sticky sessions are carried over. The
+// caller must hold the NodesMutex.
+func(cluster *Cluster) renewBalancer(config *ClusterConfig) {
+	balancer := config.NewBalancer()
+	if sticky, ok := balancer.(*StickySessionBalancer); ok {
+		sticky.inherit(cluster.balancer)
+	}
+	cluster.balancer = balancer
+}
+
+// Replaces the nodes with those of the hosts, keeping the nodes of hosts that remain. The caller
+// must hold the NodesMutex and DeadPoolMutex.
+func(cluster *Cluster) reconcile(config *ClusterConfig, hosts []string) {
+	supported := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		supported[host] = true
+	}
+	// Remove any non-supported nodes from the cluster, letting them drain
+	nodes := make([]*Node, 0, len(hosts))
+	var removed []*Node
+	for _, node := range cluster.Nodes {
+		if supported[node.Host] {
+			nodes = append(nodes, node)
+		} else {
+			removed = append(removed, node)
+		}
+	}
+	deadPool := []*Node{}
+	for _, node := range cluster.DeadPool {
+		if supported[node.Host] {
+			deadPool = append(deadPool, node)
+		} else {
+			cancelReanimation(node)
+			removed = append(removed, node)
+		}
+	}
+	cluster.drain(removed, config.drainTimeout())
+	for _, node := range removed {
+		cluster.emit(EventNodeRemoved, node.Host, nil)
+	}
+	// Add any newly supported host to the cluster, all nodes get a copy of the cluster's client
+	for _, host := range hosts {
+		if findNode(nodes, host) == nil && findNode(deadPool, host) == nil {
+			node := config.newNode(host)
+			node.Client = cluster.nodeClient(host)
+			nodes = append(nodes, node)
+			cluster.emit(EventNodeAdded, host, nil)
+		}
+	}
+	scheme := config.Scheme
+	for _, node := range append(nodes, deadPool...) {
+		node.latencyDecay.Store(math.Float64bits(config.latencyDecay()))
+		node.credentials.Store(config.credentials(node.Host))
+		node.scheme.Store(&scheme)
+	}
+	cluster.Nodes, cluster.DeadPool = nodes, deadPool
+}
+
+// CurrentConfig returns a copy of the config the cluster runs with, including the hosts added
+// and removed since. Changing it has no effect until it is passed to UpdateWithConfig.
+func(cluster *Cluster) CurrentConfig() ClusterConfig {
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	return *cluster.config.clone()
+}
+
+// Returns a copy of the config sharing none of its maps and slices. TLSClientConfig and
+// HTTPClient are shared, they are only read when a cluster is created.
+func(config *ClusterConfig) clone() *ClusterConfig {
+	cloned := *config
+	cloned.Hosts = slices.Clone(config.Hosts)
+	cloned.Weights = maps.Clone(config.Weights)
+	cloned.Groups = maps.Clone(config.Groups)
+	cloned.PathGroups = maps.Clone(config.PathGroups)
+	cloned.GroupReanimationAfter = maps.Clone(config.GroupReanimationAfter)
+	cloned.Roles = maps.Clone(config.Roles)
+	cloned.MethodRoles = maps.Clone(config.MethodRoles)
+	cloned.Tiers = maps.Clone(config.Tiers)
+	cloned.Zones = maps.Clone(config.Zones)
+	cloned.Credentials = maps.Clone(config.Credentials)
+	cloned.DefaultHeaders = config.DefaultHeaders.Clone()
+	cloned.Interceptors = slices.Clone(config.Interceptors)
+	cloned.RetriableStatusCodes = slices.Clone(config.RetriableStatusCodes)
+	return &cloned
+}
+
+// Hosts of the live nodes, copied under the read lock
+func(cluster *Cluster) LiveHosts() []string {
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	return nodeHosts(cluster.Nodes)
+}
+
+// Hosts of the nodes in the dead pool, copied under the read lock
+func(cluster *Cluster) DeadHosts() []string {
+	cluster.DeadPoolMutex.RLock()
+	defer cluster.DeadPoolMutex.RUnlock()
+	return nodeHosts(cluster.DeadPool)
+}
+
+func nodeHosts(nodes []*Node) []string {
+	hosts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		hosts = append(hosts, node.Host)
+	}
+	return hosts
+}
+
+// AddHost adds a node for the host to the cluster unless it is part of it already
+func(cluster *Cluster) AddHost(host string) {
+	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
+	cluster.DeadPoolMutex.Lock()
+	defer cluster.DeadPoolMutex.Unlock()
+	if findNode(cluster.Nodes, host) != nil || findNode(cluster.DeadPool, host) != nil {
+		return
+	}
+	node := cluster.config.newNode(host)
+	node.Client = cluster.nodeClient(host)
+	cluster.Nodes = AddNode(cluster.Nodes, node)
+	// Copy the hosts, the slice may still be shared with the config passed in by the caller
+	cluster.config.Hosts = append(append([]string{}, cluster.config.Hosts ...), host)
+	cluster.publish()
+	cluster.emit(EventNodeAdded, host, nil)
+}
+
+// RemoveHost removes the node for the host from the cluster, whether live or dead, and cancels
+// its pending reanimation
+func(cluster *Cluster) RemoveHost(host string) {
+	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
+	cluster.DeadPoolMutex.Lock()
+	defer cluster.DeadPoolMutex.Unlock()
+	if node := findNode(cluster.Nodes, host); node != nil {
+		cluster.Nodes = RemoveNode(cluster.Nodes, node)
+		cluster.drain([]*Node{node}, cluster.config.drainTimeout())
+		cluster.emit(EventNodeRemoved, host, nil)
+	}
+	if node := findNode(cluster.DeadPool, host); node != nil {
+		cluster.DeadPool = RemoveNode(cluster.DeadPool, node)
+		cancelReanimation(node)
+		cluster.drain([]*Node{node}, cluster.config.drainTimeout())
+		cluster.emit(EventNodeRemoved, host, nil)
+	}
+	cluster.config.Hosts = withoutHost(cluster.config.Hosts, host)
+	cluster.publish()
+}
+
+// Returns a copy of the hosts without the host
+func withoutHost(hosts []string, host string) []string {
+	remaining := []string{}
+	for _, configHost := range hosts {
+		if configHost != host {
+			remaining = append(remaining, configHost)
+		}
+	}
+	return remaining
 }
 
 func NewCluster(config *ClusterConfig) (cluster *Cluster, err error) {
+	if err = config.Validate(); err != nil {
+		return
+	}
 	c := &Cluster{}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.Client = config.newClient()
 	c.NodesMutex = &sync.RWMutex{}
 	c.DeadPoolMutex = &sync.RWMutex{}
+	c.events = make(chan NodeEvent, config.eventBuffer())
+	if config.resolving() {
+		c.resolve(c.ctx, config)
+	}
 	c.UpdateWithConfig(config)
+	if config.HealthCheckPath != "" {
+		c.goBackground(c.runHealthChecks)
+	}
+	if config.resolving() {
+		c.goBackground(c.runResolver)
+	}
 	cluster = c
 	return
 }
\ No newline at end of file
@@ -2,6 +2,9 @@ package cluster
 
 import (
 	"testing"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,17 +12,34 @@ import (
 	"strings"
 	"net/url"
 	"time"
+	"context"
+	"errors"
+	"sync"
+	"net"
+	"math"
+	"sync/atomic"
+	"strconv"
+	"encoding/json"
+	"expvar"
+	"sort"
 )
 
 type HTTPHandler func(w http.ResponseWriter, r *http.Request)
 
 func NewHandler(t *testing.T) HTTPHandler {
 	return func (w http.ResponseWriter, r *http.Request) {
-		t.Logf("--> Test Server received request %v on port %s", r, strings.Split(r.Host, ":")[1])
-		fmt.Fprintf(w, strings.Split(r.Host, ":")[1])	
+		_, port, _ := net.SplitHostPort(r.Host)
+		t.Logf("--> Test Server received request %v on port %s", r, port)
+		writePort(w, r)
 	}
 }
 
+// Responds with the port the request was addressed to
+func writePort(w http.ResponseWriter, r *http.Request) {
+	_, port, _ := net.SplitHostPort(r.Host)
+	fmt.Fprint(w, port)
+}
+
 func TestClusterForwardsToOneOfOneEndpoints(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(NewHandler(t)))
 	defer ts.Close()
@@ -30,6 +50,7 @@ func TestClusterForwardsToOneOfOneEndpoints(t *testing.T) {
 		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
 		return
 	}
+	defer cluster.Close()
 	u := &url.URL{Path: "/"}
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -73,6 +94,7 @@ func TestClusterForwardsToRandomOfMutlipleEndpoints(t *testing.T) {
 		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
 		return
 	}
+	defer cluster.Close()
 	u := &url.URL{Path: "/"}
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -89,6 +111,151 @@ func TestClusterForwardsToRandomOfMutlipleEndpoints(t *testing.T) {
 	}
 }
 
+func startTestServers(t *testing.T, count int) (ports []string, hosts []string, servers []*httptest.Server) {
+	for i := 0; i<count; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(NewHandler(t)))
+		port := strings.Split(ts.URL, ":")[2]
+		ports = append(ports, port)
+		hosts = append(hosts, "localhost:"+port)
+		servers = append(servers, ts)
+	}
+	t.Logf("--> Ports used in test cluster: %v", ports)
+	return
+}
+
+func closeTestServers(servers []*httptest.Server) {
+	for _, ts := range servers {
+		ts.Close()
+	}
+}
+
+// Issues a GET request against the cluster and returns the port of the serving test server
+func requestPort(t *testing.T, cluster *Cluster) string {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster request: %v", err)
+	}
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading cluster Get request response raised error: %v", err)
+	}
+	return string(buf)
+}
+
+func TestClusterRoundRobinCyclesThroughNodes(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<len(ports)*2; i++ {
+		if expected, port := ports[i%len(ports)], requestPort(t, cluster); port != expected {
+			t.Fatalf("Expected request %d to be served by port %s, got %s", i, expected, port)
+			return
+		}
+	}
+}
+
+func TestClusterSkipsZeroWeightNodes(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Weights: map[string]int{hosts[0]: 0, hosts[1]: 0, hosts[2]: 5}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<20; i++ {
+		if port := requestPort(t, cluster); port != ports[2] {
+			t.Fatalf("Expected only weighted port %s to serve requests, got %s", ports[2], port)
+			return
+		}
+	}
+	if len(cluster.Nodes) != 3 {
+		t.Fatalf("Expected zero-weight nodes to remain in the cluster, got %d nodes", len(cluster.Nodes))
+	}
+}
+
+func TestClusterRespondsErrorIfAllNodesHaveZeroWeight(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Weights: map[string]int{hosts[0]: 0, hosts[1]: 0}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if fmt.Sprintf("%v", err) != "No cluster nodes available" {
+		t.Fatalf("Expected no node to be available, got error: %v", err)
+	}
+}
+
+type lastNodeBalancer struct {}
+
+func(balancer *lastNodeBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	return nodes[len(nodes)-1]
+}
+
+type nilBalancer struct {}
+
+func(balancer *nilBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	return nil
+}
+
+func TestClusterUsesConfiguredBalancer(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<5; i++ {
+		if port := requestPort(t, cluster); port != ports[2] {
+			t.Fatalf("Expected balancer picked port %s to serve requests, got %s", ports[2], port)
+			return
+		}
+	}
+}
+
+func TestClusterRespondsErrorIfBalancerPicksNoNode(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Balancer: &nilBalancer{}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if fmt.Sprintf("%v", err) != "No cluster nodes available" {
+		t.Fatalf("Expected no node to be available, got error: %v", err)
+	}
+}
+
 func TestClusterRecognizesDeadEnds(t *testing.T) {
 	var ports []string
 	var hosts []string
@@ -102,12 +269,13 @@ func TestClusterRecognizesDeadEnds(t *testing.T) {
 	ports = append(ports, "43892")
 	hosts = append(hosts, "localhost:43892")
 	t.Logf("--> Ports used in test cluster: %v", ports)
-	config := &ClusterConfig{Hosts: hosts, NodeReanimationAfterSeconds: 1}
+	config := &ClusterConfig{Hosts: hosts, NodeReanimationAfterSeconds: 1, DialTimeout: time.Second}
 	cluster, err := NewCluster(config)
 	if err != nil {
 		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
 		return
 	}
+	defer cluster.Close()
 	u := &url.URL{Path: "/"}
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -128,7 +296,7 @@ func TestClusterRecognizesDeadEnds(t *testing.T) {
 	go func() {
 		err := srv.ListenAndServe()
 		if err != nil {
-			t.Fatalf("Error on spawning server on port %s: %v", port, err)
+			t.Errorf("Error on spawning server on port %s: %v", port, err)
 		}
 	}()
 	t.Logf("--> Server now running")
@@ -150,6 +318,7 @@ func TestClusterRespondsErrorIfAllNodesUnavailable(t *testing.T) {
 		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
 		return
 	}
+	defer cluster.Close()
 	u := &url.URL{Path: "/"}
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -163,4 +332,3830 @@ func TestClusterRespondsErrorIfAllNodesUnavailable(t *testing.T) {
 	if fmt.Sprintf("%v", err) != "No cluster nodes available" {
 		t.Fatalf("Missing expected error from request against cluster")
 	}
-}
\ No newline at end of file
+}
+
+func TestClusterStopsOnCancelledContextWithoutEvictingNode(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	port := strings.Split(ts.URL, ":")[2]
+	config := &ClusterConfig{Hosts: []string{"localhost:"+port}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster request: %v", err)
+		return
+	}
+	go func() {
+		time.Sleep(100*time.Millisecond)
+		cancel()
+	}()
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled from cancelled request, got: %v", err)
+	}
+	if len(cluster.Nodes) != 1 || len(cluster.DeadPool) != 0 {
+		t.Fatalf("Expected node to stay alive after caller cancellation, got %d live and %d dead nodes", len(cluster.Nodes), len(cluster.DeadPool))
+	}
+	resp, err = cluster.Do(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected already cancelled request to fail without an attempt, got: %v", err)
+	}
+}
+
+func TestClusterDoContextDeadlineSpansFailovers(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	port := strings.Split(ts.URL, ":")[2]
+	// Round-robin makes the dead node the first attempt and the hanging node the failover
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", "localhost:"+port}, Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster request: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	resp, err := cluster.DoContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded after failover, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "invalid port") {
+		t.Fatalf("Expected error to carry the failure of the dead node, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected failover sequence to respect the deadline, took %v", elapsed)
+	}
+}
+
+func TestClusterStopsFailoverWhenRetriesAreExhausted(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787", "localhost:324788"}
+	config := &ClusterConfig{Hosts: hosts, MaxRetries: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster request: %v", err)
+		return
+	}
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "invalid port") {
+		t.Fatalf("Expected the error of the last attempt once retries are exhausted, got: %v", err)
+	}
+	if len(cluster.Nodes) != 1 || len(cluster.DeadPool) != 2 {
+		t.Fatalf("Expected exactly two attempts, got %d live and %d dead nodes", len(cluster.Nodes), len(cluster.DeadPool))
+	}
+}
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func TestClusterHonorsRetryPolicyOfRequest(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787", "localhost:324788"}
+	config := &ClusterConfig{Hosts: hosts, MaxRetries: -1, NodeReanimationAfterSeconds: 60}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxRetries: intPtr(1), AllowNonIdempotentRetry: boolPtr(true)})
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/", nil)
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("Expected the request to fail on dead nodes")
+		return
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 2 {
+		t.Fatalf("Expected the policy to allow exactly two attempts, got dead hosts %v", dead)
+	}
+	// Requests without policy keep the cluster's settings
+	req, _ = http.NewRequest("GET", "/", nil)
+	resp, err = cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if dead := cluster.DeadHosts(); err == nil || len(dead) != 3 {
+		t.Fatalf("Expected a single attempt without policy, got dead hosts %v and error %v", dead, err)
+	}
+}
+
+func TestRetryPolicyOverridesOnlyTheFieldsItSets(t *testing.T) {
+	config := &ClusterConfig{MaxRetries: 2, AllowNonIdempotentRetry: true, BackoffBase: time.Second, BackoffMax: time.Minute}
+	overridden := config.withRetryPolicy(RetryPolicy{MaxRetries: intPtr(5)})
+	if overridden.MaxRetries != 5 || !overridden.AllowNonIdempotentRetry || overridden.BackoffBase != time.Second ||
+		overridden.BackoffMax != time.Minute {
+		t.Fatalf("Expected only MaxRetries to be overridden, got %+v", overridden)
+	}
+	if config.MaxRetries != 2 {
+		t.Fatalf("Expected the cluster's config to stay untouched, got MaxRetries %d", config.MaxRetries)
+	}
+	// Setting a field to its zero value overrides it as well
+	if overridden := config.withRetryPolicy(RetryPolicy{AllowNonIdempotentRetry: boolPtr(false)}); overridden.AllowNonIdempotentRetry {
+		t.Fatalf("Expected AllowNonIdempotentRetry to be disabled by the policy")
+	}
+}
+
+type recordingBalancer struct {
+	RandomBalancer
+	picks 	[]string
+}
+
+func(balancer *recordingBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	node := balancer.RandomBalancer.Pick(nodes, req)
+	if node != nil {
+		balancer.picks = append(balancer.picks, node.Host)
+	}
+	return node
+}
+
+func TestClusterAttemptsEachNodeAtMostOncePerRequest(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787", "localhost:324788"}
+	balancer := &recordingBalancer{}
+	config := &ClusterConfig{Hosts: hosts, Balancer: balancer}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	// Keep bringing evicted nodes back to emulate reanimations racing with the failover
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cluster.DeadPoolMutex.Lock()
+			deadNodes := cluster.DeadPool
+			cluster.DeadPool = []*Node{}
+			cluster.DeadPoolMutex.Unlock()
+			cluster.NodesMutex.Lock()
+			cluster.Nodes = AddNodes(cluster.Nodes, deadNodes)
+			cluster.NodesMutex.Unlock()
+		}
+	}()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster request: %v", err)
+		return
+	}
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if fmt.Sprintf("%v", err) != "No cluster nodes available" {
+		t.Fatalf("Missing expected error from request against cluster, got: %v", err)
+	}
+	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
+	if len(balancer.picks) != len(hosts) {
+		t.Fatalf("Expected one attempt per node, got attempts %v", balancer.picks)
+	}
+	attempted := map[string]bool{}
+	for _, host := range balancer.picks {
+		if attempted[host] {
+			t.Fatalf("Expected host %s to be attempted only once, got attempts %v", host, balancer.picks)
+		}
+		attempted[host] = true
+	}
+}
+
+func TestClusterDoIsSafeDuringConcurrentUpdates(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	done := make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Alternate between two overlapping host sets so nodes keep coming and going
+			cluster.UpdateWithConfig(&ClusterConfig{Hosts: hosts[i%2:i%2+2]})
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i<4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j<25; j++ {
+				req, _ := http.NewRequest("GET", "/", nil)
+				resp, err := cluster.Do(req)
+				if err != nil {
+					t.Errorf("Cluster client on Get request raised error: %v", err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-updated
+}
+
+func TestMatchStringReusesCompiledPatterns(t *testing.T) {
+	if !MatchString("conn.*refused", "connection refused") || MatchString("conn.*refused", "timeout") {
+		t.Fatalf("Expected pattern to match only the refused connection")
+		return
+	}
+	if MatchString("(", "(") {
+		t.Fatalf("Expected invalid pattern to match nothing")
+		return
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		MatchString("conn.*refused", "connection refused")
+	})
+	if allocs > 0 {
+		t.Fatalf("Expected matching a known pattern not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestMatchStringMatchesLiteralPatternsWithoutRegexp(t *testing.T) {
+	if !MatchString("connection refused", "dial tcp: connection refused") || MatchString("no route to host", "timeout") {
+		t.Fatalf("Expected literal pattern to match only messages containing it")
+		return
+	}
+	if _, compiled := compiledPatterns.Load("connection refused"); compiled {
+		t.Fatalf("Expected literal pattern not to be compiled")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		MatchString("invalid port", "dial tcp: address localhost:324786: invalid port")
+	})
+	if allocs > 0 {
+		t.Fatalf("Expected matching a literal pattern not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestIsNodeUnreachableInspectsErrorTypes(t *testing.T) {
+	// Grab a free port and release it again so dialing it gets refused
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unexpected error when listening on free port: %v", err)
+	}
+	closedHost := listener.Addr().String()
+	listener.Close()
+	for _, host := range []string{closedHost, "localhost:324786"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		_, err := NewNode(host).Do(req)
+		if !IsNodeUnreachable(err) {
+			t.Fatalf("Expected error of request against %s to mark node unreachable: %v", host, err)
+		}
+	}
+	if IsNodeUnreachable(errors.New("connection refused")) {
+		t.Fatalf("Expected plain error mentioning a refused connection not to mark node unreachable")
+	}
+	if IsNodeUnreachable(nil) {
+		t.Fatalf("Expected no error not to mark node unreachable")
+	}
+}
+
+func TestClusterEvictsNodesByConfiguredPredicate(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}
+	var hosts []string
+	for _, status := range statuses {
+		status := status
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		defer ts.Close()
+		hosts = append(hosts, "localhost:"+strings.Split(ts.URL, ":")[2])
+	}
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, IsNodeDead: func(resp *http.Response, err error) bool {
+		return err != nil || resp.StatusCode == http.StatusServiceUnavailable
+	}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for _, expected := range []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("Expected status %d, got %d", expected, resp.StatusCode)
+		}
+	}
+	if len(cluster.DeadPool) != 1 || cluster.DeadPool[0].Host != hosts[0] {
+		t.Fatalf("Expected only the node responding 503 to be evicted, got dead pool %v", cluster.DeadPool)
+	}
+}
+
+// Starts one test server per status, each responding with its status and its port
+func startStatusServers(t *testing.T, statuses ...int) (ports []string, hosts []string, servers []*httptest.Server) {
+	for _, status := range statuses {
+		status := status
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, strings.Split(r.Host, ":")[1])
+		}))
+		port := strings.Split(ts.URL, ":")[2]
+		ports = append(ports, port)
+		hosts = append(hosts, "localhost:"+port)
+		servers = append(servers, ts)
+	}
+	return
+}
+
+func TestClusterRetriesRetriableStatusCodesOnAnotherNode(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusBadGateway, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, RetriableStatusCodes: []int{http.StatusBadGateway}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<4; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected retriable status to be retried on healthy node, got %d", resp.StatusCode)
+		}
+	}
+	if len(cluster.Nodes) != 2 {
+		t.Fatalf("Expected retriable status not to evict nodes, got %d live nodes", len(cluster.Nodes))
+	}
+}
+
+func TestClusterNeitherRetriesNorEvictsOnClientErrors(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusNotFound, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, RetriableStatusCodes: []int{http.StatusNotFound},
+		IsNodeDead: func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode != http.StatusOK
+		}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	var notFound int
+	for i := 0; i<4; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			notFound++
+			if info, _ := AttemptInfoFromResponse(resp); info.Attempts != 1 {
+				t.Fatalf("Expected 404 to be returned without retry, got %d attempts", info.Attempts)
+			}
+		}
+	}
+	if notFound != 2 {
+		t.Fatalf("Expected every other request to be answered 404, got %d", notFound)
+	}
+	if len(cluster.Nodes) != 2 || len(cluster.DeadPool) != 0 {
+		t.Fatalf("Expected 404 not to evict nodes, got %d live nodes", len(cluster.Nodes))
+	}
+}
+
+func TestClusterReturnsLastRetriableResponseWhenNodesAreExhausted(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, RetriableStatusCodes: []int{http.StatusServiceUnavailable}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected readable 503 response once all nodes were tried, got %d: %v", resp.StatusCode, err)
+	}
+}
+
+func TestClusterDoesNotRetryNonIdempotentRequestsByDefault(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusBadGateway, http.StatusBadGateway)
+	defer closeTestServers(servers)
+	var attempts int32
+	for _, ts := range servers {
+		handler := ts.Config.Handler
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			handler.ServeHTTP(w, r)
+		})
+	}
+	config := &ClusterConfig{Hosts: hosts, RetriableStatusCodes: []int{http.StatusBadGateway}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("POST", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Post request raised error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if attempts != 1 {
+		t.Fatalf("Expected POST not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestClusterDoesNotFailOverNonIdempotentRequestsFromFailingNodes(t *testing.T) {
+	var attempts int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(200*time.Millisecond)
+	}))
+	defer slow.Close()
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	post := func(ctx context.Context, config *ClusterConfig) error {
+		cluster, err := NewCluster(config)
+		if err != nil {
+			t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+			return err
+		}
+		defer cluster.Close()
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/", nil)
+		resp, err := cluster.Do(req)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	// The last node times out after receiving the request
+	newConfig := func() *ClusterConfig {
+		return &ClusterConfig{Hosts: []string{hosts[0], slow.Listener.Addr().String()}, Balancer: &lastNodeBalancer{},
+			AttemptTimeout: 50*time.Millisecond}
+	}
+	if err := post(context.Background(), newConfig()); !errors.Is(err, ErrAttemptTimeout) || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("Expected POST not to fail over from a node that received it, got error %v", err)
+	}
+	config := newConfig()
+	config.AllowNonIdempotentRetry = true
+	if err := post(context.Background(), config); err != nil {
+		t.Fatalf("Expected POST to fail over with AllowNonIdempotentRetry, got error %v", err)
+	}
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{AllowNonIdempotentRetry: boolPtr(true)})
+	if err := post(ctx, newConfig()); err != nil {
+		t.Fatalf("Expected POST to fail over with a retry policy allowing it, got error %v", err)
+	}
+	// An unreachable node cannot have received the request
+	config = &ClusterConfig{Hosts: []string{hosts[0], "localhost:324786"}, Balancer: &lastNodeBalancer{}}
+	if err := post(context.Background(), config); err != nil {
+		t.Fatalf("Expected POST to fail over from an unreachable node, got error %v", err)
+	}
+}
+
+func TestClusterResendsRequestBodyOnFailover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer ts.Close()
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", "localhost:"+strings.Split(ts.URL, ":")[2]}, Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("payload"))
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Put request raised error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != "payload" {
+		t.Fatalf("Expected payload to be resent after failover, got `%s`", string(buf))
+	}
+}
+
+func TestClusterFailsRetryOfStreamingRequestBody(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts ...), Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	body, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("payload"))
+		writer.Close()
+	}()
+	req, _ := http.NewRequest("PUT", "/", body)
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if !errors.Is(err, ErrBodyNotReplayable) {
+		t.Fatalf("Expected streaming body not to be replayed, got: %v", err)
+	}
+}
+
+func TestClusterAddressesNodesWithConfiguredScheme(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(NewHandler(t)))
+	defer ts.Close()
+	port := strings.Split(ts.URL, ":")[2]
+	// The test certificate is issued for the loopback address rather than localhost
+	config := &ClusterConfig{Hosts: []string{"127.0.0.1:"+port}, Scheme: "https"}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	// Trust the certificate of the test server
+	cluster.Nodes[0].Client = ts.Client()
+	if respondedPort := requestPort(t, cluster); respondedPort != port {
+		t.Fatalf("Expected responded port %s to equal server port %s", respondedPort, port)
+	}
+}
+
+func TestClusterAppliesTLSSettingsToEveryNode(t *testing.T) {
+	var ports []string
+	var hosts []string
+	pool := x509.NewCertPool()
+	for i := 0; i<2; i++ {
+		ts := httptest.NewTLSServer(http.HandlerFunc(NewHandler(t)))
+		defer ts.Close()
+		pool.AddCert(ts.Certificate())
+		port := strings.Split(ts.URL, ":")[2]
+		ports = append(ports, port)
+		hosts = append(hosts, "127.0.0.1:"+port)
+	}
+	config := &ClusterConfig{Hosts: hosts, Scheme: "https", Strategy: StrategyRoundRobin, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for _, node := range cluster.Nodes {
+		if transport, ok := node.Client.Transport.(*http.Transport); !ok || transport.TLSClientConfig.RootCAs != pool {
+			t.Fatalf("Expected node %s to use the configured TLS settings", node.Host)
+		}
+	}
+	for i := 0; i<len(ports); i++ {
+		if port := requestPort(t, cluster); port != ports[i] {
+			t.Fatalf("Expected request %d to be served by port %s, got %s", i, ports[i], port)
+		}
+	}
+}
+
+// Stands in for a RoundTripper other than *http.Transport
+type countingRoundTripper struct {
+	requests 	atomic.Int64
+}
+
+func(roundTripper *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	roundTripper.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClusterClonesConfiguredTransportForEveryNode(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	template := &http.Transport{MaxIdleConnsPerHost: 7, DisableCompression: true}
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, HTTPClient: &http.Client{Transport: template, Timeout: time.Minute}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	transports := map[*http.Transport]bool{}
+	for _, node := range cluster.Nodes {
+		transport, ok := node.Client.Transport.(*http.Transport)
+		if !ok || transport == template {
+			t.Fatalf("Expected node %s to get a clone of the configured transport, got %v", node.Host, node.Client.Transport)
+			return
+		}
+		if transport.MaxIdleConnsPerHost != 7 || !transport.DisableCompression || node.Client.Timeout != time.Minute {
+			t.Fatalf("Expected node %s to carry the configured client settings", node.Host)
+		}
+		transports[transport] = true
+	}
+	if len(transports) != len(cluster.Nodes) {
+		t.Fatalf("Expected every node to get a transport of its own, got %d for %d nodes", len(transports), len(cluster.Nodes))
+	}
+	for i := 0; i<2; i++ {
+		requestPort(t, cluster)
+	}
+	roundTripper := &countingRoundTripper{}
+	config = &ClusterConfig{Hosts: hosts, HTTPClient: &http.Client{Transport: roundTripper}}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for _, node := range cluster.Nodes {
+		if node.Client.Transport != roundTripper {
+			t.Fatalf("Expected node %s to share the custom RoundTripper", node.Host)
+		}
+	}
+	requestPort(t, cluster)
+	if requests := roundTripper.requests.Load(); requests != 1 {
+		t.Fatalf("Expected the request to be sent through the custom RoundTripper, got %d requests", requests)
+	}
+}
+
+func TestClusterAppliesUpdatedSchemeToExistingNodes(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(writePort))
+	defer ts.Close()
+	host := ts.Listener.Addr().String()
+	config := &ClusterConfig{Hosts: []string{host}, HTTPClient: ts.Client()}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	status := func() int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return 0
+		}
+		discardResponse(resp)
+		return resp.StatusCode
+	}
+	if code := status(); code != http.StatusBadRequest {
+		t.Fatalf("Expected plain HTTP to be rejected by the TLS node, got status %d", code)
+		return
+	}
+	config = &ClusterConfig{Hosts: []string{host}, HTTPClient: ts.Client(), Scheme: "https"}
+	cluster.UpdateWithConfig(config)
+	config.Scheme = "http"
+	if code := status(); code != http.StatusOK {
+		t.Fatalf("Expected the existing node to be addressed with the updated scheme, got status %d", code)
+	}
+}
+
+// Responds with the protocol the request was received with
+func writeProto(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, r.Proto)
+}
+
+func TestClusterForcesHTTP2OnNodes(t *testing.T) {
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(writeProto))
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(writeProto))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+	for _, config := range []*ClusterConfig{
+		{Hosts: []string{h2c.Listener.Addr().String()}, ForceHTTP2: true},
+		{Hosts: []string{tlsServer.Listener.Addr().String()}, Scheme: "https", TLSClientConfig: &tls.Config{RootCAs: pool}, ForceHTTP2: true},
+	} {
+		cluster, err := NewCluster(config)
+		if err != nil {
+			t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+			return
+		}
+		defer cluster.Close()
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Fatalf("Expected node %s to be spoken to with HTTP/2, got %s received as %s", config.Hosts[0], resp.Proto, body)
+		}
+	}
+}
+
+func TestClusterUsesConfiguredHTTPClient(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	config := &ClusterConfig{Hosts: []string{"localhost:"+strings.Split(ts.URL, ":")[2]}, HTTPClient: &http.Client{Timeout: 100*time.Millisecond}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	started := time.Now()
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Expected client timeout error from hanging node, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected client timeout to abort the request, took %v", elapsed)
+	}
+}
+
+func TestClusterReanimatesNodesPassingHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	config := &ClusterConfig{
+		Hosts: []string{"localhost:"+strings.Split(ts.URL, ":")[2]},
+		HealthCheckPath: "/healthz",
+		HealthCheckInterval: 20*time.Millisecond,
+		IsNodeDead: func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode == http.StatusServiceUnavailable
+		},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	liveHosts := func() int {
+		cluster.NodesMutex.RLock()
+		defer cluster.NodesMutex.RUnlock()
+		return len(cluster.Nodes)
+	}
+	if liveHosts() != 0 {
+		t.Fatalf("Expected unhealthy node to be evicted")
+	}
+	time.Sleep(200*time.Millisecond)
+	if liveHosts() != 0 {
+		t.Fatalf("Expected node failing its health checks to stay dead")
+	}
+	healthy.Store(true)
+	for deadline := time.Now().Add(time.Second); liveHosts() == 0; time.Sleep(10*time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected node passing its health check to be reanimated")
+		}
+	}
+}
+
+func TestClusterCloseStopsPendingReanimations(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:324786"}, NodeReanimationAfterSeconds: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	cluster.Do(req)
+	closed := make(chan struct{})
+	go func() {
+		cluster.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(500*time.Millisecond):
+		t.Fatalf("Expected Close not to wait for the pending reanimation timer")
+	}
+	time.Sleep(time.Second)
+	if len(cluster.Nodes) != 0 {
+		t.Fatalf("Expected pending reanimation to be cancelled by Close")
+	}
+	if _, err := cluster.Do(req); !errors.Is(err, ErrClusterClosed) {
+		t.Fatalf("Expected request after Close to fail with ErrClusterClosed, got: %v", err)
+	}
+}
+
+func TestClusterReanimatesNodesAfterConfiguredDuration(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:324786"}, NodeReanimationAfterSeconds: 60, NodeReanimationAfter: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	cluster.Do(req)
+	time.Sleep(300*time.Millisecond)
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	if len(cluster.Nodes) != 1 {
+		t.Fatalf("Expected node to be reanimated after NodeReanimationAfter")
+	}
+}
+
+func TestReanimationDelaySaturatesLargeSeconds(t *testing.T) {
+	config := &ClusterConfig{NodeReanimationAfterSeconds: math.MaxInt64}
+	if delay := config.reanimationDelay(); delay <= 0 {
+		t.Fatalf("Expected huge reanimation delay not to overflow, got %v", delay)
+	}
+}
+
+func TestReanimationJitterSpreadsDelays(t *testing.T) {
+	config := &ClusterConfig{ReanimationJitter: 0.2}
+	spread := map[time.Duration]bool{}
+	for i := 0; i<100; i++ {
+		delay := config.jitter(10*time.Second)
+		if delay < 8*time.Second || delay > 12*time.Second {
+			t.Fatalf("Expected delay within 20%% of 10s, got %v", delay)
+		}
+		spread[delay] = true
+	}
+	if len(spread) < 50 {
+		t.Fatalf("Expected jittered delays to differ, got %d distinct delays", len(spread))
+	}
+	if delay := config.jitter(math.MaxInt64); delay <= 0 {
+		t.Fatalf("Expected huge jittered delay not to overflow, got %v", delay)
+	}
+	if delay := (&ClusterConfig{}).jitter(10*time.Second); delay != 10*time.Second {
+		t.Fatalf("Expected delay without jitter to be kept, got %v", delay)
+	}
+}
+
+func TestReanimationBacksOffForRelapsingNodes(t *testing.T) {
+	config := &ClusterConfig{MaxReanimationAfter: time.Minute}
+	node := NewNode("localhost:1")
+	if delay := config.backoffReanimation(node, 10*time.Second); delay != 10*time.Second {
+		t.Fatalf("Expected regular delay on the first eviction, got %v", delay)
+	}
+	for _, expected := range []time.Duration{20*time.Second, 40*time.Second, time.Minute, time.Minute} {
+		node.reanimatedAt.Store(time.Now().UnixNano())
+		if delay := config.backoffReanimation(node, 10*time.Second); delay != expected {
+			t.Fatalf("Expected delay of %v for a relapsing node, got %v", expected, delay)
+		}
+	}
+	node.reanimatedAt.Store(time.Now().Add(-2*time.Minute).UnixNano())
+	if delay := config.backoffReanimation(node, 10*time.Second); delay != 10*time.Second {
+		t.Fatalf("Expected regular delay once the node stayed alive, got %v", delay)
+	}
+	if delay := (&ClusterConfig{}).backoffReanimation(node, 10*time.Second); delay != 10*time.Second {
+		t.Fatalf("Expected regular delay without MaxReanimationAfter, got %v", delay)
+	}
+}
+
+func TestClusterBacksOffHealthChecksOfRelapsingNodes(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	interval := 20*time.Millisecond
+	config := &ClusterConfig{Hosts: hosts, HealthCheckPath: "/health", HealthCheckInterval: interval,
+		MaxReanimationAfter: time.Minute}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	node := cluster.Nodes[0]
+	// Evicts the node and returns the time it took the health checks to reanimate it
+	relapse := func() time.Duration {
+		evicted := time.Now()
+		cluster.evict(node, errors.New("Relapsed"))
+		for node.State() == NodeDead {
+			if time.Since(evicted) > 5*time.Second {
+				return time.Since(evicted)
+			}
+			time.Sleep(5*time.Millisecond)
+		}
+		return time.Since(evicted)
+	}
+	relapse()
+	// Each relapse within MaxReanimationAfter doubles the interval, holding off the probes for
+	// 1, 3, 7 and 15 intervals
+	for _, holdOff := range []int{1, 3, 7, 15} {
+		took := relapse()
+		if took < time.Duration(holdOff)*interval {
+			t.Fatalf("Expected relapsing node to be probed after %v at the earliest, got reanimated after %v", time.Duration(holdOff)*interval, took)
+			return
+		}
+		t.Logf("--> Relapsing node reanimated after %v", took)
+	}
+	node.reanimatedAt.Store(time.Now().Add(-2*time.Minute).UnixNano())
+	if took := relapse(); took > 5*time.Second {
+		t.Fatalf("Expected node that stayed alive to be reanimated by the health checks, got %v", took)
+	}
+	if probeAfter := node.probeAfter.Load(); probeAfter > time.Now().UnixNano() {
+		t.Fatalf("Expected node that stayed alive not to be held off")
+	}
+}
+
+func TestClusterEvictsNodesAfterConsecutiveFailureThreshold(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusServiceUnavailable, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, FailureThreshold: 3, IsNodeDead: func(resp *http.Response, err error) bool {
+		return err != nil || resp.StatusCode == http.StatusServiceUnavailable
+	}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 1; i<=3; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected failing node to be failed over, got status %d", resp.StatusCode)
+		}
+		if evicted := len(cluster.DeadPool) == 1; evicted != (i == 3) {
+			t.Fatalf("Expected node to be evicted only after 3 consecutive failures, got %d dead nodes after %d failures", len(cluster.DeadPool), i)
+		}
+	}
+}
+
+func TestClusterSkipsNodesWithOpenCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	config := &ClusterConfig{
+		Hosts: []string{"localhost:"+strings.Split(ts.URL, ":")[2]},
+		BreakerThreshold: 2,
+		BreakerCooldown: 100*time.Millisecond,
+		IsNodeDead: func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode == http.StatusServiceUnavailable
+		},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	do := func() *http.Response {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, _ := cluster.Do(req)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return resp
+	}
+	do()
+	do()
+	if state := cluster.Nodes[0].BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to open after 2 failures, got state %v", state)
+	}
+	if resp := do(); resp != nil || requests.Load() != 2 {
+		t.Fatalf("Expected node with open breaker to be skipped without a request, got %d requests", requests.Load())
+	}
+	time.Sleep(150*time.Millisecond)
+	healthy.Store(true)
+	if resp := do(); resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected trial request to pass the half-open breaker")
+	}
+	if state := cluster.Nodes[0].BreakerState(); state != BreakerClosed {
+		t.Fatalf("Expected successful trial to close the breaker, got state %v", state)
+	}
+	if len(cluster.DeadPool) != 0 {
+		t.Fatalf("Expected breaker to replace eviction, got %d dead nodes", len(cluster.DeadPool))
+	}
+}
+
+func TestClusterOpensCircuitBreakerOnErrorResponses(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	config := &ClusterConfig{Hosts: []string{ts.Listener.Addr().String()}, BreakerThreshold: 2,
+		BreakerCooldown: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	do := func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if resp, _ := cluster.Do(req); resp != nil {
+			resp.Body.Close()
+		}
+	}
+	do()
+	do()
+	if state := cluster.Nodes[0].BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to open after 2 error responses, got state %v", state)
+	}
+	time.Sleep(100*time.Millisecond)
+	do()
+	if state := cluster.Nodes[0].BreakerState(); state != BreakerOpen || requests.Load() != 3 {
+		t.Fatalf("Expected the failing trial to open the breaker again, got state %v after %d requests", state, requests.Load())
+	}
+}
+
+func TestClusterBacksOffBetweenFailovers(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787", "localhost:324788"}
+	config := &ClusterConfig{Hosts: hosts, BackoffBase: 40*time.Millisecond, BackoffMax: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	started := time.Now()
+	cluster.Do(req)
+	// Two failovers pausing at least 20ms and 25ms
+	if elapsed := time.Since(started); elapsed < 45*time.Millisecond {
+		t.Fatalf("Expected failovers to back off, took only %v", elapsed)
+	}
+}
+
+func TestClusterBackoffRespectsRequestContext(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787"}
+	config := &ClusterConfig{Hosts: hosts, BackoffBase: time.Minute}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	started := time.Now()
+	if _, err := cluster.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context deadline to interrupt the backoff, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected backoff to end with the context, took %v", elapsed)
+	}
+}
+
+func TestBackoffGrowsExponentiallyUpToMax(t *testing.T) {
+	config := &ClusterConfig{BackoffBase: 10*time.Millisecond, BackoffMax: 35*time.Millisecond}
+	for failover, max := range []time.Duration{0, 10*time.Millisecond, 20*time.Millisecond, 35*time.Millisecond, 35*time.Millisecond} {
+		if backoff := config.backoff(failover); backoff > max || backoff < max/2 {
+			t.Fatalf("Expected backoff of failover %d between %v and %v, got %v", failover, max/2, max, backoff)
+		}
+	}
+}
+
+func TestClusterReportsEveryAttemptedNodeWhenAllAreUnavailable(t *testing.T) {
+	hosts := []string{"localhost:324786", "localhost:324787"}
+	config := &ClusterConfig{Hosts: hosts}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	_, err = cluster.Do(req)
+	var unavailableErr *AllNodesUnavailableError
+	if !errors.As(err, &unavailableErr) || !errors.Is(err, ErrNoNodesAvailable) {
+		t.Fatalf("Expected AllNodesUnavailableError, got: %v", err)
+	}
+	if len(unavailableErr.Attempts) != len(hosts) {
+		t.Fatalf("Expected one recorded attempt per node, got %v", unavailableErr.Attempts)
+	}
+	for _, host := range hosts {
+		if !strings.Contains(unavailableErr.Details(), host) {
+			t.Fatalf("Expected error details to name attempted host %s, got: %v", host, unavailableErr.Details())
+		}
+	}
+	var addrErr *net.AddrError
+	if !errors.As(err, &addrErr) {
+		t.Fatalf("Expected underlying attempt errors to be unwrappable, got: %v", err)
+	}
+}
+
+func TestClusterJoinsEveryAttemptErrorWhenRetriesAreExhausted(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(NewHandler(t)))
+	closedHost := closed.Listener.Addr().String()
+	closed.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	config := &ClusterConfig{Hosts: []string{closedHost, slow.Listener.Addr().String()}, MaxRetries: 1, AttemptTimeout: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	_, err = cluster.Do(req)
+	if !errors.Is(err, ErrAttemptTimeout) || !IsNodeUnreachable(err) {
+		t.Fatalf("Expected error to wrap both the timeout and the refused connection, got: %v", err)
+	}
+	for _, host := range config.Hosts {
+		if !strings.Contains(err.Error(), host) {
+			t.Fatalf("Expected error to name attempted host %s, got: %v", host, err)
+		}
+	}
+}
+
+func TestClusterDoWithNodeReportsServingNode(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts ...)}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<5; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, node, err := cluster.DoWithNode(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if node == nil || node.Host != "localhost:"+string(buf) {
+			t.Fatalf("Expected serving node to match responding port %s of %v, got %v", string(buf), ports, node)
+		}
+	}
+}
+
+func TestClusterStatsCountRequestsPerNode(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts ...), Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<3; i++ {
+		requestPort(t, cluster)
+	}
+	stats := cluster.Stats()
+	if dead := stats["localhost:324786"]; dead.Requests != 1 || dead.Failures != 1 || dead.Successes != 0 {
+		t.Fatalf("Expected one failed request on the dead node, got %+v", dead)
+	}
+	if live := stats[hosts[0]]; live.Requests != 3 || live.Successes != 3 || live.Failures != 0 || live.AverageLatency() <= 0 {
+		t.Fatalf("Expected three successful requests on the live node, got %+v", live)
+	}
+}
+
+func TestClusterStatsCountErrorResponsesAsFailures(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusInternalServerError)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<5; i++ {
+		requestPort(t, cluster)
+	}
+	if stats := cluster.Stats()[hosts[0]]; stats.Requests != 5 || stats.Successes != 0 || stats.Failures != 5 {
+		t.Fatalf("Expected every 500 response to count as failure, got %+v", stats)
+	}
+	if len(cluster.DeadPool) != 0 {
+		t.Fatalf("Expected the node answering 500 to stay live, got %d dead nodes", len(cluster.DeadPool))
+	}
+}
+
+func TestClusterInvokesNodeLifecycleHooks(t *testing.T) {
+	var mutex sync.Mutex
+	var events []string
+	config := &ClusterConfig{
+		Hosts: []string{"localhost:324786"},
+		NodeReanimationAfter: 50*time.Millisecond,
+		OnNodeDead: func(host string, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, fmt.Sprintf("dead %s %v", host, err != nil))
+		},
+		OnNodeReanimated: func(host string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, "reanimated "+host)
+		},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	cluster.Do(req)
+	time.Sleep(200*time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []string{"dead localhost:324786 true", "reanimated localhost:324786"}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatalf("Expected hook calls %v, got %v", expected, events)
+	}
+}
+
+type recordingLogger struct {
+	mutex 	sync.Mutex
+	lines 	[]string
+}
+
+func(logger *recordingLogger) Printf(format string, args ...interface{}) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.lines = append(logger.lines, fmt.Sprintf(format, args ...))
+}
+
+func TestClusterLogsNodeEvents(t *testing.T) {
+	logger := &recordingLogger{}
+	config := &ClusterConfig{Hosts: []string{"localhost:324786"}, Logger: logger}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/path", nil)
+	cluster.Do(req)
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	expected := []string{"Cluster selected node localhost:324786 for GET /path", "Cluster evicted node localhost:324786", "Cluster has no node left for GET /path"}
+	if len(logger.lines) != len(expected) {
+		t.Fatalf("Expected %d log lines, got %v", len(expected), logger.lines)
+	}
+	for idx, prefix := range expected {
+		if !strings.HasPrefix(logger.lines[idx], prefix) {
+			t.Fatalf("Expected log line %d to start with `%s`, got `%s`", idx, prefix, logger.lines[idx])
+		}
+	}
+}
+
+type recordingTracer struct {
+	spans 	[]string
+}
+
+type recordingSpan struct {
+	tracer 	*recordingTracer
+	name 	string
+}
+
+func(tracer *recordingTracer) StartAttempt(ctx context.Context, host string, attempt int) (context.Context, AttemptSpan) {
+	return ctx, &recordingSpan{tracer: tracer, name: fmt.Sprintf("%s#%d", host, attempt)}
+}
+
+func(span *recordingSpan) End(err error, failover bool) {
+	span.tracer.spans = append(span.tracer.spans, fmt.Sprintf("%s failed=%v failover=%v", span.name, err != nil, failover))
+}
+
+func TestClusterTracesEveryAttempt(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	tracer := &recordingTracer{}
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts ...), Strategy: StrategyRoundRobin, Tracer: tracer}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	requestPort(t, cluster)
+	expected := []string{"localhost:324786#1 failed=true failover=true", hosts[0]+"#2 failed=false failover=false"}
+	if fmt.Sprint(tracer.spans) != fmt.Sprint(expected) {
+		t.Fatalf("Expected spans %v, got %v", expected, tracer.spans)
+	}
+}
+
+func TestClusterAddsAndRemovesHostsAtRuntime(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts[:1], Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	cluster.AddHost(hosts[1])
+	cluster.AddHost(hosts[1])
+	for i := 0; i<4; i++ {
+		if port := requestPort(t, cluster); port != ports[i%2] {
+			t.Fatalf("Expected request %d to be served by port %s, got %s", i, ports[i%2], port)
+		}
+	}
+	cluster.RemoveHost(hosts[0])
+	if current := cluster.CurrentConfig(); fmt.Sprint(current.Hosts) != fmt.Sprint(hosts[1:]) {
+		t.Fatalf("Expected config hosts to follow runtime changes, got %v", current.Hosts)
+	}
+	if len(config.Hosts) != 1 || config.Hosts[0] != hosts[0] {
+		t.Fatalf("Expected config passed to the cluster to stay untouched, got %v", config.Hosts)
+	}
+	// Reconciling against the cluster's own config keeps the runtime changes
+	current := cluster.CurrentConfig()
+	cluster.UpdateWithConfig(&current)
+	for i := 0; i<2; i++ {
+		if port := requestPort(t, cluster); port != ports[1] {
+			t.Fatalf("Expected removed host not to serve requests, got port %s", port)
+		}
+	}
+}
+
+func TestClusterRemoveHostCancelsPendingReanimation(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:324786"}, NodeReanimationAfter: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	cluster.Do(req)
+	cluster.RemoveHost("localhost:324786")
+	time.Sleep(150*time.Millisecond)
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	if len(cluster.Nodes) != 0 || len(cluster.DeadPool) != 0 {
+		t.Fatalf("Expected removed host not to be reanimated, got %d live and %d dead nodes", len(cluster.Nodes), len(cluster.DeadPool))
+	}
+}
+
+func TestClusterReportsLiveAndDeadHosts(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts ...), Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if live := cluster.LiveHosts(); len(live) != 2 || len(cluster.DeadHosts()) != 0 {
+		t.Fatalf("Expected all hosts to be live initially, got %v", live)
+	}
+	requestPort(t, cluster)
+	if live, dead := cluster.LiveHosts(), cluster.DeadHosts(); fmt.Sprint(live) != fmt.Sprint(hosts) || fmt.Sprint(dead) != "[localhost:324786]" {
+		t.Fatalf("Expected dead host to move to the dead hosts, got live %v and dead %v", live, dead)
+	}
+}
+
+func TestAddNodeAndRemoveNodeIdentifyNodesByHost(t *testing.T) {
+	nodes := AddNode(nil, NewNode("localhost:1"))
+	nodes = AddNode(nodes, NewNode("localhost:1"))
+	if len(nodes) != 1 {
+		t.Fatalf("Expected node for the same host not to be added twice, got %d nodes", len(nodes))
+	}
+	nodes = AddNodes(nodes, []*Node{NewNode("localhost:2"), NewNode("localhost:1")})
+	if len(nodes) != 2 {
+		t.Fatalf("Expected only the new host to be added, got %d nodes", len(nodes))
+	}
+	nodes = RemoveNode(nodes, NewNode("localhost:1"))
+	if len(nodes) != 1 || nodes[0].Host != "localhost:2" {
+		t.Fatalf("Expected node to be removed by host, got %v", nodeHosts(nodes))
+	}
+}
+
+func TestClusterUpdateWithConfigKeepsExistingNodes(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts[:2]}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	requestPort(t, cluster)
+	existing := map[string]*Node{}
+	for _, node := range cluster.Nodes {
+		existing[node.Host] = node
+	}
+	cluster.UpdateWithConfig(&ClusterConfig{Hosts: hosts[1:]})
+	if fmt.Sprint(cluster.LiveHosts()) != fmt.Sprint(hosts[1:]) {
+		t.Fatalf("Expected live hosts %v, got %v", hosts[1:], cluster.LiveHosts())
+	}
+	if cluster.Nodes[0] != existing[hosts[1]] {
+		t.Fatalf("Expected node of remaining host %s to be kept", hosts[1])
+	}
+	if stats := cluster.Stats(); stats[hosts[1]] != existing[hosts[1]].Stats() {
+		t.Fatalf("Expected stats of remaining host to be kept, got %+v", stats[hosts[1]])
+	}
+}
+
+func TestNewClusterRejectsMalformedHosts(t *testing.T) {
+	for _, host := range []string{"", "localhost", "http://localhost", "localhost:", ":8080", "localhost:http"} {
+		config := &ClusterConfig{Hosts: []string{"localhost:8080", host}}
+		if _, err := NewCluster(config); err == nil {
+			t.Fatalf("Expected malformed host `%s` to be rejected", host)
+		}
+	}
+	if err := ValidateHost("127.0.0.1:8080"); err != nil {
+		t.Fatalf("Unexpected error when validating host: %v", err)
+	}
+}
+
+func TestNewClusterRejectsEmptyHostList(t *testing.T) {
+	for _, hosts := range [][]string{nil, {}} {
+		if _, err := NewCluster(&ClusterConfig{Hosts: hosts}); !errors.Is(err, ErrNoHosts) {
+			t.Fatalf("Expected ErrNoHosts for hosts %v, got: %v", hosts, err)
+		}
+	}
+}
+
+func TestClusterForwardsToIPv6Nodes(t *testing.T) {
+	var ports []string
+	var hosts []string
+	for i := 0; i<2; i++ {
+		listener, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback not available: %v", err)
+		}
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(NewHandler(t)))
+		ts.Listener.Close()
+		ts.Listener = listener
+		ts.Start()
+		defer ts.Close()
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		ports = append(ports, port)
+		hosts = append(hosts, "[::1]:"+port)
+	}
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, HealthCheckPath: "/"}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<len(ports); i++ {
+		if port := requestPort(t, cluster); port != ports[i] {
+			t.Fatalf("Expected request %d to be served by port %s, got %s", i, ports[i], port)
+		}
+	}
+	if !CheckNodeHealth(context.Background(), cluster.Nodes[0], "/") {
+		t.Fatalf("Expected health check of IPv6 node to pass")
+	}
+}
+
+func TestValidateHostHandlesIPv6(t *testing.T) {
+	for _, host := range []string{"[::1]:8080", "[2001:db8::1]:443", "[fe80::1%eth0]:80"} {
+		if err := ValidateHost(host); err != nil {
+			t.Fatalf("Unexpected error when validating host `%s`: %v", host, err)
+		}
+	}
+	for _, host := range []string{"::1:8080", "[::1]", "[localhost]:8080", "[::1]:"} {
+		if err := ValidateHost(host); err == nil {
+			t.Fatalf("Expected malformed host `%s` to be rejected", host)
+		}
+	}
+}
+
+func TestClusterDeduplicatesConfiguredHosts(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: []string{hosts[0], hosts[0], hosts[1], hosts[0]}, Strategy: StrategyRoundRobin}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if fmt.Sprint(cluster.LiveHosts()) != fmt.Sprint(hosts) || fmt.Sprint(cluster.CurrentConfig().Hosts) != fmt.Sprint(hosts) {
+		t.Fatalf("Expected a single node per host in order, got nodes %v and hosts %v", cluster.LiveHosts(), cluster.CurrentConfig().Hosts)
+	}
+	served := map[string]int{}
+	for i := 0; i<10; i++ {
+		served[requestPort(t, cluster)]++
+	}
+	if served[ports[0]] != 5 || served[ports[1]] != 5 {
+		t.Fatalf("Expected duplicate host not to get more traffic, got %v", served)
+	}
+}
+
+func TestClusterSplitsReadsAndWritesByRole(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Roles: map[string]string{hosts[0]: RolePrimary, hosts[1]: RoleReplica, hosts[2]: RoleReplica}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	requestMethodPort := func(method string) string {
+		req, _ := http.NewRequest(method, "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on %s request raised error: %v", method, err)
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return string(buf)
+	}
+	for i := 0; i<10; i++ {
+		if port := requestMethodPort("POST"); port != ports[0] {
+			t.Fatalf("Expected write to be routed to primary port %s, got %s", ports[0], port)
+		}
+		if port := requestMethodPort("GET"); port == ports[0] {
+			t.Fatalf("Expected read to be routed to a replica, got primary port %s", port)
+		}
+	}
+	cluster.RemoveHost(hosts[0])
+	if port := requestMethodPort("DELETE"); port == ports[0] {
+		t.Fatalf("Expected write to fall back to any node without primaries, got port %s", port)
+	}
+}
+
+func TestClusterPrefersPrimaryTier(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts...), Tiers: map[string]int{hosts[1]: 1}, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<10; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected request to be routed to primary port %s, got %s", ports[0], port)
+			return
+		}
+	}
+	t.Logf("--> Primaries preferred over backups")
+	cluster.RemoveHost(hosts[0])
+	if port := requestPort(t, cluster); port != ports[1] {
+		t.Fatalf("Expected request to fail over to backup port %s, got %s", ports[1], port)
+		return
+	}
+	t.Logf("--> Backup used once no primary is available")
+	cluster.AddHost(hosts[0])
+	if port := requestPort(t, cluster); port != ports[0] {
+		t.Fatalf("Expected re-added primary port %s to preempt backup, got %s", ports[0], port)
+		return
+	}
+}
+
+func TestClusterRoutesPathPrefixesToGroups(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), NodeReanimationAfter: time.Hour,
+		Groups: map[string]string{hosts[0]: "auth", "localhost:324786": "billing", hosts[1]: "billing"},
+		PathGroups: map[string]string{"/auth/": "auth", "/billing/": "billing", "/billing/export/": DefaultGroup}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	requestPathPort := func(path string) (string, error) {
+		req, _ := http.NewRequest("GET", path, nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+	for path, port := range map[string]string{"/auth/login": ports[0], "/billing/invoices": ports[1], "/billing/export/all": ports[2], "/": ports[2]} {
+		for i := 0; i<5; i++ {
+			if served, err := requestPathPort(path); err != nil || served != port {
+				t.Fatalf("Expected %s to be routed to port %s, got %s: %v", path, port, served, err)
+				return
+			}
+		}
+	}
+	t.Logf("--> Paths routed to the nodes of their group")
+	cluster.RemoveHost(hosts[0])
+	if _, err := requestPathPort("/auth/login"); !errors.Is(err, ErrNoNodesAvailable) {
+		t.Fatalf("Expected requests of a group without nodes to fail rather than leave the group, got %v", err)
+	}
+}
+
+func TestClusterSendsRequestsToNamedGroups(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), NodeReanimationAfter: time.Hour,
+		Groups: map[string]string{hosts[1]: "search", "localhost:324786": "search"},
+		GroupReanimationAfter: map[string]time.Duration{"search": 50*time.Millisecond}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<5; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected Do to be routed to the default group on port %s, got %s", ports[0], port)
+			return
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.DoGroup("search", req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != ports[1] {
+			t.Fatalf("Expected DoGroup to be routed to the search group on port %s, got %s", ports[1], body)
+			return
+		}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := cluster.DoGroup("unknown", req); !errors.Is(err, ErrNoNodesAvailable) {
+		t.Fatalf("Expected request to a group without nodes to fail, got %v", err)
+	}
+	stats := cluster.GroupStats()
+	if len(stats[DefaultGroup]) != 1 || len(stats["search"]) != 2 || stats["search"][hosts[1]].Requests != 5 {
+		t.Fatalf("Expected stats to be grouped, got %v", stats)
+	}
+	// The dead node of the search group is reanimated after the delay of its group
+	for i := 0; i<50 && len(cluster.DeadHosts()) == 0; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if resp, err := cluster.DoGroup("search", req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if len(cluster.DeadHosts()) != 1 {
+		t.Fatalf("Expected the unreachable node to be evicted, got dead hosts %v", cluster.DeadHosts())
+		return
+	}
+	deadline := time.Now().Add(2*time.Second)
+	for len(cluster.DeadHosts()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected dead node to be reanimated after the delay of its group, got dead hosts %v", cluster.DeadHosts())
+			return
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterPrefersLocalZone(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts...), NodeReanimationAfter: time.Hour, LocalZone: "eu-1a",
+		Zones: map[string]string{"localhost:324786": "eu-1a", hosts[0]: "eu-1a", hosts[1]: "eu-1b"}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<10; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected request to stay in the local zone on port %s, got %s", ports[0], port)
+			return
+		}
+	}
+	t.Logf("--> Local zone preferred over remote zone")
+	cluster.RemoveHost(hosts[0])
+	if port := requestPort(t, cluster); port != ports[1] {
+		t.Fatalf("Expected request to fail over to the remote zone on port %s, got %s", ports[1], port)
+	}
+}
+
+func TestClusterSelectsNodesWithRequestSelector(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{"localhost:324786"}, hosts...), NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	var offered [][]string
+	// Prefers the unreachable node, then the last one
+	selector := func(nodes []*Node) *Node {
+		offered = append(offered, nodeHosts(nodes))
+		for _, node := range nodes {
+			if node.Host == "localhost:324786" {
+				return node
+			}
+		}
+		return nodes[len(nodes)-1]
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.DoSelect(req, selector)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != ports[1] || len(offered) != 2 || len(offered[1]) != 2 {
+		t.Fatalf("Expected selector to fail over from the dead node to port %s, got %s after offers %v", ports[1], body, offered)
+		return
+	}
+	// Without a pick of the selector the balancer decides
+	req, _ = http.NewRequest("GET", "/", nil)
+	resp, err = cluster.DoSelect(req, func(nodes []*Node) *Node { return nil })
+	if err != nil {
+		t.Fatalf("Expected balancer to select a node the selector did not pick, got %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func TestClusterBroadcast(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	broadcast := func() []NodeResponse {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader("invalidate"))
+		return cluster.Broadcast(req)
+	}
+	responses := broadcast()
+	if len(responses) != 3 {
+		t.Fatalf("Expected a response per node, got %v", responses)
+		return
+	}
+	for i, port := range ports {
+		if responses[i].Host != hosts[i] || responses[i].Err != nil {
+			t.Fatalf("Expected broadcast to node %s to succeed, got %v", hosts[i], responses[i])
+			return
+		}
+		buf, _ := ioutil.ReadAll(responses[i].Response.Body)
+		responses[i].Response.Body.Close()
+		if string(buf) != port {
+			t.Fatalf("Expected response of port %s, got %s", port, buf)
+			return
+		}
+	}
+	if responses[2].Err == nil {
+		t.Fatalf("Expected broadcast to dead node to fail")
+		return
+	}
+	if len(cluster.LiveHosts()) != 3 {
+		t.Fatalf("Expected broadcast not to evict nodes, got live hosts %v", cluster.LiveHosts())
+		return
+	}
+	t.Logf("--> Broadcast reached every node without evicting")
+	config.BroadcastEvicts = true
+	cluster.UpdateWithConfig(config)
+	for _, response := range broadcast() {
+		if response.Response != nil {
+			response.Response.Body.Close()
+		}
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != "localhost:324786" {
+		t.Fatalf("Expected broadcast to evict the dead node, got dead hosts %v", dead)
+		return
+	}
+}
+
+func TestClusterBroadcastReplaysBody(t *testing.T) {
+	var mutex sync.Mutex
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(buf))
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	cluster, err := NewCluster(&ClusterConfig{Hosts: []string{host, "localhost:" + strings.Split(host, ":")[1]}})
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster: %v", err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("payload"))
+	for _, response := range cluster.Broadcast(req) {
+		if response.Err != nil {
+			t.Fatalf("Broadcast to %s raised error: %v", response.Host, response.Err)
+			return
+		}
+		response.Response.Body.Close()
+	}
+	if len(bodies) != 2 || bodies[0] != "payload" || bodies[1] != "payload" {
+		t.Fatalf("Expected every node to receive the body, got %v", bodies)
+		return
+	}
+}
+
+func TestClusterHedgesSlowRequests(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	release := make(chan struct{})
+	cancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	hosts = append(hosts, slow.Listener.Addr().String())
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}, HedgeAfter: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if port := requestPort(t, cluster); port != ports[0] {
+		t.Fatalf("Expected hedged request to be served by fast port %s, got %s", ports[0], port)
+		return
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5*time.Second):
+		t.Fatalf("Expected request to the slow node to be cancelled")
+		return
+	}
+	t.Logf("--> Hedged request served by the faster node and the slower one cancelled")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/", nil)
+	if _, err := cluster.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected non-idempotent request not to be hedged, got error %v", err)
+		return
+	}
+}
+
+func TestClusterHedgesHonorNodeLimits(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int64
+	var hits sync.Map
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := hits.LoadOrStore(r.Host, new(atomic.Int64))
+		count.(*atomic.Int64).Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(100*time.Millisecond)
+		}
+	})
+	var hosts []string
+	for i := 0; i<2; i++ {
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		hosts = append(hosts, ts.Listener.Addr().String())
+	}
+	config := &ClusterConfig{Hosts: hosts, HedgeAfter: 20*time.Millisecond, MaxConcurrentPerNode: 1,
+		QueueTimeout: 5*time.Second}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	var wg sync.WaitGroup
+	for i := 0; i<6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/slow", nil)
+			if resp, err := cluster.Do(req); err == nil {
+				discardResponse(resp)
+			}
+		}()
+	}
+	wg.Wait()
+	if max := maxInFlight.Load(); max > 2 {
+		t.Fatalf("Expected hedges to respect the limit of 1 request per node, got %d requests in flight", max)
+	}
+	hits = sync.Map{}
+	config = &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, HedgeAfter: 20*time.Millisecond,
+		RatePerNode: 0.001, Burst: 1}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	// The first node spends its only token, the slow request on the second node must not be
+	// hedged on the first
+	for _, path := range []string{"/", "/slow"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		discardResponse(resp)
+	}
+	for _, host := range hosts {
+		if count, ok := hits.Load(host); !ok || count.(*atomic.Int64).Load() != 1 {
+			t.Fatalf("Expected every node to be sent a single request within its rate, got hits on %s: %v", host, count)
+		}
+	}
+}
+
+func TestClusterHedgeWaitsForSuccessWhenHedgeNodeFails(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100*time.Millisecond)
+		writePort(w, r)
+	}))
+	defer slow.Close()
+	slowHost := slow.Listener.Addr().String()
+	_, slowPort, _ := net.SplitHostPort(slowHost)
+	// The slow node is picked first, the hedge goes to the node refusing connections
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", slowHost}, Balancer: &lastNodeBalancer{},
+		HedgeAfter: 20*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if port := requestPort(t, cluster); port != slowPort {
+		t.Fatalf("Expected the slow but healthy node to serve the request, got port %s", port)
+	}
+	// A body that cannot be replayed is never hedged, so the hedge node does not count as tried
+	req, _ := http.NewRequest("PUT", "/", ioutil.NopCloser(strings.NewReader("payload")))
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Put request raised error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if info, _ := AttemptInfoFromResponse(resp); len(info.Hosts) != 1 || info.Hosts[0] != slowHost {
+		t.Fatalf("Expected only the slow node to be tried, got %v", info.Hosts)
+	}
+}
+
+func TestClusterDoParallelReturnsFirstSuccess(t *testing.T) {
+	ports, hosts, servers := startStatusServers(t, http.StatusInternalServerError, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.DoParallel(req, 3)
+	if err != nil {
+		t.Fatalf("Parallel request raised error: %v", err)
+		return
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(buf) != ports[1] {
+		t.Fatalf("Expected successful response of port %s, got %s", ports[1], buf)
+		return
+	}
+	t.Logf("--> Parallel request returned the successful response")
+	time.Sleep(100*time.Millisecond)
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != "localhost:324786" {
+		t.Fatalf("Expected the unreachable node to be evicted during the race, got dead hosts %v", dead)
+		return
+	}
+	cluster.RemoveHost(hosts[1])
+	req, _ = http.NewRequest("GET", "/", nil)
+	_, err = cluster.DoParallel(req, 2)
+	var unavailable *AllNodesUnavailableError
+	if !errors.As(err, &unavailable) || len(unavailable.Attempts) != 1 || unavailable.Attempts[0].Host != hosts[0] {
+		t.Fatalf("Expected failures of all raced nodes, got %v", err)
+		return
+	}
+}
+
+func TestClusterDoParallelHonorsLimits(t *testing.T) {
+	release := make(chan struct{})
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer blocking.Close()
+	defer close(release)
+	ports, hosts, servers := startStatusServers(t, http.StatusInternalServerError, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: []string{blocking.Listener.Addr().String()}, MaxConcurrentPerNode: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := cluster.DoParallel(req, 0); err != ErrInvalidParallelism {
+		t.Fatalf("Expected ErrInvalidParallelism when racing no node, got %v", err)
+	}
+	go cluster.DoParallel(req, 1)
+	for deadline := time.Now().Add(time.Second); cluster.Nodes[0].InFlight() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10*time.Millisecond)
+	}
+	if _, err := cluster.DoParallel(req, 1); err != ErrNodesSaturated {
+		t.Fatalf("Expected the node with its slot taken to be left out, got %v", err)
+	}
+	// Nodes answering 500 lose the race and count as failures
+	config = &ClusterConfig{Hosts: hosts}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	resp, err := cluster.DoParallel(req, 2)
+	if err != nil {
+		t.Fatalf("Parallel request raised error: %v", err)
+		return
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(buf) != ports[1] {
+		t.Fatalf("Expected successful response of port %s, got %s", ports[1], buf)
+	}
+	// The 500 response may also arrive after the race was decided, it is never a success
+	time.Sleep(50*time.Millisecond)
+	if stats := cluster.Stats()[hosts[0]]; stats.Successes != 0 {
+		t.Fatalf("Expected the 500 response not to count as success, got %+v", stats)
+	}
+}
+
+func TestRetryAfterParsesSecondsAndDates(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"120": 2*time.Minute,
+		"0": 0,
+		now.Add(30*time.Second).Format(http.TimeFormat): 30*time.Second,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+		if delay, ok := retryAfter(resp, now); !ok || delay != expected {
+			t.Fatalf("Expected Retry-After `%s` to be parsed as %v, got %v (%v)", value, expected, delay, ok)
+			return
+		}
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+		if delay, ok := retryAfter(resp, now); ok {
+			t.Fatalf("Expected Retry-After `%s` to be ignored, got %v", value, delay)
+			return
+		}
+	}
+}
+
+func TestClusterHonorsRetryAfter(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	hosts = append(hosts, unavailable.Listener.Addr().String())
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}, HonorRetryAfter: true}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected first request to get the 503, got %v (%v)", resp, err)
+		return
+	}
+	resp.Body.Close()
+	for i := 0; i<5; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected suspended node to be skipped, got port %s", port)
+			return
+		}
+	}
+	if len(cluster.LiveHosts()) != 2 {
+		t.Fatalf("Expected suspended node not to be evicted, got live hosts %v", cluster.LiveHosts())
+		return
+	}
+}
+
+func TestClusterReducesShareOfSuspectNodes(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	var failed atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failed.Swap(true) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "flaky")
+	}))
+	defer flaky.Close()
+	hosts = append(hosts, flaky.Listener.Addr().String())
+	isNodeDead := func(resp *http.Response, err error) bool {
+		return err != nil || resp.StatusCode == http.StatusInternalServerError
+	}
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}, IsNodeDead: isNodeDead, FailureThreshold: 3, SuspectShare: 1e-12}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	flakyNode := cluster.Nodes[1]
+	if port := requestPort(t, cluster); port != ports[0] {
+		t.Fatalf("Expected request to fail over to port %s, got %s", ports[0], port)
+		return
+	}
+	if state := flakyNode.State(); state != NodeSuspect {
+		t.Fatalf("Expected failed node to be suspect, got %v", state)
+		return
+	}
+	for i := 0; i<20; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected suspect node to be picked rarely, got response %s", port)
+			return
+		}
+	}
+	t.Logf("--> Suspect node received a reduced share of requests")
+	cluster.RemoveHost(hosts[0])
+	if body := requestPort(t, cluster); body != "flaky" {
+		t.Fatalf("Expected suspect node to serve without healthy nodes, got response %s", body)
+		return
+	}
+	if state := flakyNode.State(); state != NodeHealthy {
+		t.Fatalf("Expected suspect node to turn healthy after a success, got %v", state)
+		return
+	}
+}
+
+func TestClusterEjectsOutliers(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK, http.StatusOK)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, NodeReanimationAfter: time.Hour, OutlierErrorRate: 0.5, OutlierMinRequests: 3, MaxOutlierEjection: 0.25}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<20; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	dead := cluster.DeadHosts()
+	if len(dead) != 1 || (dead[0] != hosts[0] && dead[0] != hosts[1]) {
+		t.Fatalf("Expected exactly one failing node to be ejected within the cap, got dead hosts %v", dead)
+		return
+	}
+}
+
+func TestClusterKeepsMinHealthyNodes(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", "localhost:324787", "localhost:324788"}, NodeReanimationAfter: time.Hour, MinHealthyNodes: 2}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<5; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		_, err := cluster.Do(req)
+		var unavailable *AllNodesUnavailableError
+		if !errors.As(err, &unavailable) {
+			t.Fatalf("Expected all flaky nodes to fail, got %v", err)
+			return
+		}
+		if i > 0 && len(unavailable.Attempts) != 2 {
+			t.Fatalf("Expected the remaining live nodes to be tried, got %v", unavailable.Attempts)
+			return
+		}
+	}
+	if live := cluster.LiveHosts(); len(live) != 2 {
+		t.Fatalf("Expected eviction to stop at 2 live nodes, got %v", live)
+		return
+	}
+}
+
+func TestClusterLimitsConcurrencyPerNode(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	defer server.Close()
+	config := &ClusterConfig{Hosts: []string{server.Listener.Addr().String()}, MaxConcurrentPerNode: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	blocked := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "/block", nil)
+		resp, err := cluster.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		blocked <- err
+	}()
+	<-entered
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := cluster.Do(req); err != ErrNodesSaturated {
+		t.Fatalf("Expected request to a saturated node to fail, got %v", err)
+		return
+	}
+	t.Logf("--> Request to saturated node failed without queueing")
+	config.QueueTimeout = 5*time.Second
+	cluster.UpdateWithConfig(config)
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	req, _ = http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Expected queued request to be served once a slot was freed, got %v", err)
+		return
+	}
+	resp.Body.Close()
+	if err := <-blocked; err != nil {
+		t.Fatalf("Blocking request raised error: %v", err)
+		return
+	}
+}
+
+func TestClusterLimitsRequestsInFlight(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	defer server.Close()
+	config := &ClusterConfig{Hosts: []string{server.Listener.Addr().String()}, MaxInFlight: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	blocked := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "/block", nil)
+		resp, err := cluster.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		blocked <- err
+	}()
+	<-entered
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := cluster.Do(req); err != ErrClusterSaturated {
+		t.Fatalf("Expected request beyond the limit to fail fast, got %v", err)
+		return
+	}
+	t.Logf("--> Request beyond the limit failed fast")
+	config.BlockWhenSaturated = true
+	cluster.UpdateWithConfig(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "/", nil)
+	if _, err := cluster.Do(req); err != context.DeadlineExceeded {
+		t.Fatalf("Expected blocked request to give up with its context, got %v", err)
+		return
+	}
+	t.Logf("--> Blocked request respected its context")
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	req, _ = http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Expected blocked request to be served once a request finished, got %v", err)
+		return
+	}
+	resp.Body.Close()
+	if err := <-blocked; err != nil {
+		t.Fatalf("Blocking request raised error: %v", err)
+		return
+	}
+}
+
+func TestClusterRateLimitsNodes(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}, RatePerNode: 10, Burst: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if port := requestPort(t, cluster); port != ports[1] {
+		t.Fatalf("Expected first request on port %s, got %s", ports[1], port)
+		return
+	}
+	if port := requestPort(t, cluster); port != ports[0] {
+		t.Fatalf("Expected request to prefer the node with tokens left on port %s, got %s", ports[0], port)
+		return
+	}
+	started := time.Now()
+	requestPort(t, cluster)
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected request to wait for the next token, took %v", elapsed)
+		return
+	}
+}
+
+func TestClusterResolvesHostsPeriodically(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	port := strings.Split(hosts[0], ":")[1]
+	var mutex sync.Mutex
+	addrs := []string{"127.0.0.1", "127.0.0.2"}
+	var lookupErr error
+	lookupHost := func(ctx context.Context, host string) ([]string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if host != "backends.test" {
+			t.Errorf("Unexpected lookup of %s", host)
+		}
+		return addrs, lookupErr
+	}
+	config := &ClusterConfig{Hosts: []string{"backends.test:" + port}, ResolveInterval: 20*time.Millisecond, LookupHost: lookupHost}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	expectLiveHosts := func(expected ...string) {
+		deadline := time.Now().Add(5*time.Second)
+		for {
+			live := cluster.LiveHosts()
+			if strings.Join(live, ",") == strings.Join(expected, ",") {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected live hosts %v, got %v", expected, live)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+	expectLiveHosts("127.0.0.1:" + port, "127.0.0.2:" + port)
+	t.Logf("--> Nodes created for the resolved addresses")
+	mutex.Lock()
+	addrs = []string{"127.0.0.1", "127.0.0.3"}
+	mutex.Unlock()
+	expectLiveHosts("127.0.0.1:" + port, "127.0.0.3:" + port)
+	t.Logf("--> Nodes follow changed records")
+	mutex.Lock()
+	addrs, lookupErr = nil, errors.New("Lookup failed")
+	mutex.Unlock()
+	time.Sleep(100*time.Millisecond)
+	expectLiveHosts("127.0.0.1:" + port, "127.0.0.3:" + port)
+	if port := requestPort(t, cluster); port != strings.Split(hosts[0], ":")[1] {
+		t.Fatalf("Expected request to be served by a resolved node, got port %s", port)
+		return
+	}
+}
+
+func TestClusterBalancesSRVTargetsByPriorityAndWeight(t *testing.T) {
+	ports, _, servers := startTestServers(t, 4)
+	defer closeTestServers(servers)
+	records := []*net.SRV{}
+	for i, weight := range []uint16{0, 10, 30, 50} {
+		number, _ := strconv.Atoi(ports[i])
+		priority := uint16(10)
+		if i == 3 {
+			priority = 20
+		}
+		records = append(records, &net.SRV{Target: "localhost.", Port: uint16(number), Priority: priority, Weight: weight})
+	}
+	lookupSRV := func(ctx context.Context, name string) ([]*net.SRV, error) {
+		return records, nil
+	}
+	config := &ClusterConfig{SRVService: "_http._tcp.backends.test", LookupSRV: lookupSRV}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	served := map[string]int{}
+	for i := 0; i<400; i++ {
+		served[requestPort(t, cluster)]++
+	}
+	t.Logf("--> Requests served by port: %v", served)
+	if served[ports[3]] != 0 {
+		t.Fatalf("Expected the target of the higher priority to get no requests, got %d", served[ports[3]])
+	}
+	if served[ports[0]] == 0 || served[ports[0]] > 40 {
+		t.Fatalf("Expected the zero-weight target to get a small share of the requests, got %d", served[ports[0]])
+	}
+	if ratio := float64(served[ports[2]]) / float64(served[ports[1]]); ratio < 2 || ratio > 4.5 {
+		t.Fatalf("Expected targets to share requests by weight, got a ratio of %.2f", ratio)
+	}
+}
+
+func TestClusterDiscoversNodesViaSRV(t *testing.T) {
+	ports, _, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	portNumber := func(port string) uint16 {
+		number, _ := strconv.Atoi(port)
+		return uint16(number)
+	}
+	var mutex sync.Mutex
+	records := []*net.SRV{
+		{Target: "127.0.0.1.", Port: portNumber(ports[0]), Priority: 10, Weight: 5},
+		{Target: "localhost.", Port: portNumber(ports[1]), Priority: 20, Weight: 5},
+	}
+	lookupSRV := func(ctx context.Context, name string) ([]*net.SRV, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return records, nil
+	}
+	config := &ClusterConfig{SRVService: "_http._tcp.backends.test", ResolveInterval: 20*time.Millisecond, LookupSRV: lookupSRV}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if live := cluster.LiveHosts(); len(live) != 2 || live[0] != "127.0.0.1:" + ports[0] || live[1] != "localhost:" + ports[1] {
+		t.Fatalf("Expected nodes for the SRV targets, got %v", live)
+		return
+	}
+	for i := 0; i<5; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected requests to go to the target of the lowest priority on port %s, got %s", ports[0], port)
+			return
+		}
+	}
+	t.Logf("--> SRV targets discovered and prioritized")
+	mutex.Lock()
+	records = records[1:]
+	mutex.Unlock()
+	deadline := time.Now().Add(5*time.Second)
+	for len(cluster.LiveHosts()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected removed SRV target to be dropped, got %v", cluster.LiveHosts())
+			return
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if port := requestPort(t, cluster); port != ports[1] {
+		t.Fatalf("Expected requests to go to the remaining target on port %s, got %s", ports[1], port)
+		return
+	}
+}
+
+func TestClusterSupportsUnixSocketNodes(t *testing.T) {
+	dir := t.TempDir()
+	socket := dir + "/app.sock"
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unexpected error when listen on unix socket: %v", err)
+		return
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "unix " + r.Host)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+	if err := ValidateHost(UnixHostPrefix); err == nil {
+		t.Fatalf("Expected unix host without path to be rejected")
+		return
+	}
+	config := &ClusterConfig{Hosts: []string{UnixHostPrefix + socket, UnixHostPrefix + dir + "/missing.sock"}, Strategy: StrategyRoundRobin, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<4; i++ {
+		if body := requestPort(t, cluster); body != "unix localhost" {
+			t.Fatalf("Expected request to be served over the unix socket, got %s", body)
+			return
+		}
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != UnixHostPrefix + dir + "/missing.sock" {
+		t.Fatalf("Expected node of the missing socket to be evicted, got dead hosts %v", dead)
+		return
+	}
+}
+
+func TestClusterAddsDefaultHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization") + " " + r.Header.Get("User-Agent"))
+	}))
+	defer server.Close()
+	config := &ClusterConfig{
+		Hosts: []string{server.Listener.Addr().String(), "localhost:324786"},
+		Balancer: &lastNodeBalancer{},
+		DefaultHeaders: http.Header{"Authorization": []string{"Bearer token"}, "user-agent": []string{"cluster"}},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "caller")
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if string(buf) != "Bearer token caller" {
+		t.Fatalf("Expected default headers on the failover attempt without overwriting the caller's, got `%s`", buf)
+		return
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatalf("Expected the caller's request to be left untouched, got header %v", req.Header)
+		return
+	}
+}
+
+func TestClusterRunsInterceptorsOnEveryAttempt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Correlation-Id") + " " + r.URL.Path)
+	}))
+	defer server.Close()
+	var mutex sync.Mutex
+	var calls []string
+	record := func(name string) Interceptor {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mutex.Lock()
+				calls = append(calls, name)
+				mutex.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	rewrite := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Correlation-Id", "42")
+			req.URL.Path = "/v2" + req.URL.Path
+			return next.RoundTrip(req)
+		})
+	}
+	config := &ClusterConfig{
+		Hosts: []string{server.Listener.Addr().String(), "localhost:324786"},
+		Balancer: &lastNodeBalancer{},
+		Interceptors: []Interceptor{record("outer"), rewrite, record("inner")},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if body := requestPort(t, cluster); body != "42 /v2/" {
+		t.Fatalf("Expected request to pass the interceptors, got `%s`", body)
+		return
+	}
+	if strings.Join(calls, ",") != "outer,inner,outer,inner" {
+		t.Fatalf("Expected both attempts to pass the interceptors in order, got %v", calls)
+		return
+	}
+}
+
+func TestClusterReusesConnections(t *testing.T) {
+	for _, disableKeepAlives := range []bool{false, true} {
+		var connections atomic.Int64
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Connection") == "keep-alive" {
+				t.Errorf("Unexpected Connection header set on the request")
+			}
+		}))
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections.Add(1)
+			}
+		}
+		server.Start()
+		config := &ClusterConfig{Hosts: []string{server.Listener.Addr().String()}, DisableKeepAlives: disableKeepAlives}
+		cluster, err := NewCluster(config)
+		if err != nil {
+			t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+			return
+		}
+		defer cluster.Close()
+		for i := 0; i<5; i++ {
+			requestPort(t, cluster)
+		}
+		server.Close()
+		if expected := map[bool]int64{false: 1, true: 5}[disableKeepAlives]; connections.Load() != expected {
+			t.Fatalf("Expected %d connections with DisableKeepAlives %v, got %d", expected, disableKeepAlives, connections.Load())
+			return
+		}
+	}
+}
+
+func TestClusterAppliesIdleConnectionSettingsToNodes(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:1", "localhost:2"}, MaxIdleConns: 200, MaxIdleConnsPerHost: 50, IdleConnTimeout: time.Minute}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for _, node := range cluster.Nodes {
+		transport, ok := node.Client.Transport.(*http.Transport)
+		if !ok || transport.MaxIdleConns != 200 || transport.MaxIdleConnsPerHost != 50 || transport.IdleConnTimeout != time.Minute {
+			t.Fatalf("Expected node %s to use the configured idle connection settings, got %v", node.Host, node.Client.Transport)
+			return
+		}
+	}
+	defaults := http.DefaultTransport.(*http.Transport)
+	cluster, _ = NewCluster(&ClusterConfig{Hosts: []string{"localhost:1"}, MaxIdleConnsPerHost: 50})
+	defer cluster.Close()
+	transport := cluster.Nodes[0].Client.Transport.(*http.Transport)
+	if transport.MaxIdleConns != defaults.MaxIdleConns || transport.IdleConnTimeout != defaults.IdleConnTimeout {
+		t.Fatalf("Expected unset idle connection settings to keep the defaults")
+	}
+}
+
+func TestClusterDialsNodesWithConfiguredDialer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(NewHandler(t)))
+	defer ts.Close()
+	var dialed []string
+	var mutex sync.Mutex
+	dialer := &net.Dialer{}
+	// Every node is served by the test server, whatever address it is dialed at
+	config := &ClusterConfig{Hosts: []string{"backend.invalid:80"}, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mutex.Lock()
+		dialed = append(dialed, addr)
+		mutex.Unlock()
+		return dialer.DialContext(ctx, network, ts.Listener.Addr().String())
+	}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if port := requestPort(t, cluster); port != "80" {
+		t.Fatalf("Expected request to be addressed to port 80 of the node, got %s", port)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(dialed) != 1 || dialed[0] != "backend.invalid:80" {
+		t.Fatalf("Expected the configured dialer to dial the node, got %v", dialed)
+	}
+}
+
+func TestClusterFailsOverWhenDialingTimesOut(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(NewHandler(t)))
+	defer ts.Close()
+	live := ts.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	// The unresponsive node never completes its connection, as with a port dropping packets
+	config := &ClusterConfig{Hosts: []string{"unresponsive.invalid:80"}, Strategy: StrategyRoundRobin, DialTimeout: 50*time.Millisecond,
+		NodeReanimationAfterSeconds: 60, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "unresponsive.invalid:80" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	cluster.AddHost(live)
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Expected request to fail over to the live node, got error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("Expected the dial to the unresponsive node to time out quickly, took %v", elapsed)
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != "unresponsive.invalid:80" {
+		t.Fatalf("Expected the unresponsive node to be evicted, got dead hosts %v", dead)
+	}
+}
+
+func TestClusterSendsRequestsThroughConfiguredProxy(t *testing.T) {
+	var proxied []string
+	var mutex sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		proxied = append(proxied, r.URL.Host)
+		mutex.Unlock()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	hosts := []string{"first.invalid:80", "second.invalid:80"}
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin, Proxy: http.ProxyURL(proxyURL)}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for range hosts {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(proxied) != 2 || proxied[0] != hosts[0] || proxied[1] != hosts[1] {
+		t.Fatalf("Expected requests to every node to pass the proxy, got %v", proxied)
+	}
+}
+
+func TestClusterLeavesCallersRequestUntouched(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), Balancer: &lastNodeBalancer{}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/path", nil)
+	for i := 0; i<2; i++ {
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(buf) != ports[0] {
+			t.Fatalf("Expected request to be served by port %s, got %s", ports[0], buf)
+			return
+		}
+		if req.URL.String() != "/path" || len(req.Header) != 0 {
+			t.Fatalf("Expected the caller's request to be left untouched, got URL %s and header %v", req.URL, req.Header)
+			return
+		}
+	}
+}
+
+func TestClusterFailsOverOnAttemptTimeout(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	hosts = append(hosts, slow.Listener.Addr().String())
+	config := &ClusterConfig{Hosts: hosts, Balancer: &lastNodeBalancer{}, AttemptTimeout: 50*time.Millisecond, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	if _, err := cluster.Do(req); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrAttemptTimeout) {
+		t.Fatalf("Expected the caller's deadline to end the request, got %v", err)
+		return
+	}
+	if len(cluster.DeadHosts()) != 0 {
+		t.Fatalf("Expected no eviction when the caller gave up, got dead hosts %v", cluster.DeadHosts())
+		return
+	}
+	t.Logf("--> Caller deadline did not evict the node")
+	if port := requestPort(t, cluster); port != ports[0] {
+		t.Fatalf("Expected timed out attempt to fail over to port %s, got %s", ports[0], port)
+		return
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != hosts[1] {
+		t.Fatalf("Expected the timed out node to be evicted, got dead hosts %v", dead)
+		return
+	}
+}
+
+func TestClusterReportsAttemptsWithResponse(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), Balancer: &lastNodeBalancer{}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	info, ok := AttemptInfoFromResponse(resp)
+	if !ok || info.Attempts != 2 || info.Hosts[0] != "localhost:324786" || info.Hosts[1] != hosts[0] {
+		t.Fatalf("Expected both attempts to be reported, got %v (%v)", info, ok)
+		return
+	}
+	if _, ok := AttemptInfoFromContext(req.Context()); ok {
+		t.Fatalf("Expected the caller's request context to be left untouched")
+		return
+	}
+}
+
+func TestClusterDrainsRemovedNodes(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, "drained")
+	}))
+	defer server.Close()
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append([]string{server.Listener.Addr().String()}, hosts...), Strategy: StrategyRoundRobin, DrainTimeout: 5*time.Second}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	node := cluster.Nodes[0]
+	blocked := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "/block", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			blocked <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		blocked <- string(buf)
+	}()
+	<-entered
+	cluster.RemoveHost(node.Host)
+	if state := node.State(); state != NodeDraining {
+		t.Fatalf("Expected removed node with a request in flight to drain, got %v", state)
+		return
+	}
+	for i := 0; i<3; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected no new requests on the draining node, got %s", port)
+			return
+		}
+	}
+	close(release)
+	if body := <-blocked; body != "drained" {
+		t.Fatalf("Expected the request in flight to finish, got %s", body)
+		return
+	}
+	deadline := time.Now().Add(5*time.Second)
+	for node.State() != NodeRemoved {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected node to be drained, got %v", node.State())
+			return
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterClosesIdleConnectionsOfEvictedNodes(t *testing.T) {
+	var connections atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	config := &ClusterConfig{Hosts: []string{server.Listener.Addr().String()}, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	node := cluster.Nodes[0]
+	if node.Client == &cluster.Client || node.Client.Transport == cluster.Client.Transport {
+		t.Fatalf("Expected node to hold a transport of its own")
+		return
+	}
+	requestPort(t, cluster)
+	cluster.evict(node, errors.New("Evicted by test"))
+	cluster.reanimate(node)
+	requestPort(t, cluster)
+	if connections.Load() != 2 {
+		t.Fatalf("Expected a fresh connection after the reanimation, got %d connections", connections.Load())
+		return
+	}
+}
+
+func TestClusterRecoversFromPanickingCallbacks(t *testing.T) {
+	logger := &recordingLogger{}
+	reanimated := make(chan struct{}, 1)
+	config := &ClusterConfig{
+		Hosts: []string{"localhost:324786"},
+		NodeReanimationAfter: 10*time.Millisecond,
+		Logger: logger,
+		OnNodeDead: func(host string, err error) {
+			panic("dead")
+		},
+		OnNodeReanimated: func(host string) {
+			reanimated <- struct{}{}
+			panic("reanimated")
+		},
+	}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := cluster.Do(req); err == nil {
+		t.Fatalf("Expected request to the dead node to fail")
+		return
+	}
+	<-reanimated
+	recovered := func() int {
+		logger.mutex.Lock()
+		defer logger.mutex.Unlock()
+		count := 0
+		for _, line := range logger.lines {
+			if strings.HasPrefix(line, "Cluster recovered from panic") {
+				count++
+			}
+		}
+		return count
+	}
+	deadline := time.Now().Add(5*time.Second)
+	for recovered() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected both panics to be recovered and logged, got %v", logger.lines)
+			return
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if len(cluster.LiveHosts()) != 1 {
+		t.Fatalf("Expected node to be reanimated despite the panicking callback")
+		return
+	}
+}
+
+// Logger panicking on lines mentioning a reanimation
+type panickingLogger struct {}
+
+func(logger panickingLogger) Printf(format string, args ...interface{}) {
+	if line := fmt.Sprintf(format, args...); strings.Contains(line, "reanimated") {
+		panic(line)
+	}
+}
+
+type panickingRoundTripper struct {}
+
+func(roundTripper panickingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	panic("round trip")
+}
+
+func TestClusterRecoversFromPanicsInRequestGoroutines(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, HealthCheckPath: "/health", HealthCheckInterval: 10*time.Millisecond,
+		Logger: panickingLogger{}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	cluster.evict(cluster.Nodes[0], errors.New("Evicted by test"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.WaitReady(ctx, 2); err != nil {
+		t.Fatalf("Expected the node to be reanimated despite the panicking logger, got %v", err)
+		return
+	}
+	config = &ClusterConfig{Hosts: hosts, HTTPClient: &http.Client{Transport: panickingRoundTripper{}},
+		HedgeAfter: 10*time.Millisecond, NodeReanimationAfter: time.Hour}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, response := range cluster.Broadcast(req) {
+		if response.Err != errCallbackPanicked {
+			t.Fatalf("Expected broadcast to %s to fail with the recovered panic, got %v", response.Host, response.Err)
+		}
+	}
+	if _, err := cluster.DoParallel(req, 2); err == nil {
+		t.Fatalf("Expected parallel requests through a panicking transport to fail")
+	}
+	if _, err := cluster.Do(req); err == nil {
+		t.Fatalf("Expected hedged requests through a panicking transport to fail")
+	}
+}
+
+func TestClusterKeepsStickySessionsAcrossConfigUpdates(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 3)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyStickySession, SessionKey: HeaderHashKey("X-Session")}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	sessionPort := func(session string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session", session)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return ""
+		}
+		defer resp.Body.Close()
+		port, _ := ioutil.ReadAll(resp.Body)
+		return string(port)
+	}
+	ports := map[string]string{}
+	for i := 0; i<10; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		ports[session] = sessionPort(session)
+	}
+	updated := cluster.CurrentConfig()
+	updated.MaxRetries = 2
+	cluster.UpdateWithConfig(&updated)
+	for session, port := range ports {
+		if actual := sessionPort(session); actual != port {
+			t.Fatalf("Expected session %s to stay on port %s after the config update, got %s", session, port, actual)
+		}
+	}
+}
+
+func TestClusterAdminHandlerReportsState(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), Strategy: StrategyRoundRobin, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<2; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected request to be served by port %s, got %s", ports[0], port)
+			return
+		}
+	}
+	admin := httptest.NewServer(cluster.AdminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/debug/cluster")
+	if err != nil {
+		t.Fatalf("Unexpected error when requesting admin handler: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	var state AdminState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected JSON state, got %s: %v", resp.Header.Get("Content-Type"), err)
+		return
+	}
+	t.Logf("--> Admin state %+v", state)
+	if len(state.Nodes) != 1 || state.Nodes[0].Host != hosts[0] || state.Nodes[0].Requests != 2 || state.Nodes[0].State != "healthy" {
+		t.Fatalf("Expected the live node with its stats, got %+v", state.Nodes)
+	}
+	if len(state.DeadNodes) != 1 || state.DeadNodes[0].Host != "localhost:324786" || state.DeadNodes[0].State != "dead" {
+		t.Fatalf("Expected the evicted node among the dead nodes, got %+v", state.DeadNodes)
+	}
+	if state.Config.Strategy != StrategyRoundRobin || state.Config.NodeReanimationAfter != time.Hour || len(state.Config.Hosts) != 2 {
+		t.Fatalf("Expected the current config, got %+v", state.Config)
+	}
+}
+
+func TestClusterPublishesExpvarCounters(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), Strategy: StrategyRoundRobin, NodeReanimationAfter: 50*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	// Expvars cannot be unpublished, each run of the test needs names of its own
+	prefix := fmt.Sprintf("test_cluster_%d", time.Now().UnixNano())
+	if err := cluster.PublishExpvar(prefix); err != nil {
+		t.Fatalf("Unexpected error when publishing expvars: %v", err)
+		return
+	}
+	if err := cluster.PublishExpvar(prefix); err == nil {
+		t.Fatalf("Expected publishing the same names twice to fail")
+	}
+	for i := 0; i<3; i++ {
+		requestPort(t, cluster)
+	}
+	expect := func(name, value string) {
+		if actual := expvar.Get(prefix + "." + name).String(); actual != value {
+			t.Fatalf("Expected expvar %s to be %s, got %s", name, value, actual)
+		}
+	}
+	expect("requests", "3")
+	expect("failures", "0")
+	expect("evictions", "1")
+	expect("liveNodes", "1")
+	deadline := time.Now().Add(2*time.Second)
+	for expvar.Get(prefix + ".reanimations").String() != "1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the reanimation to be counted")
+			return
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	expect("liveNodes", "2")
+}
+
+func TestClusterAuthenticatesRequestsWithNodeCredentials(t *testing.T) {
+	authorizations := make(chan string, 10)
+	servers := []*httptest.Server{}
+	var hosts []string
+	for i := 0; i<2; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorizations <- r.Header.Get("Authorization")
+		}))
+		servers = append(servers, ts)
+		hosts = append(hosts, ts.Listener.Addr().String())
+	}
+	defer closeTestServers(servers)
+	var intercepted []string
+	config := &ClusterConfig{Hosts: hosts, Strategy: StrategyRoundRobin,
+		Credentials: map[string]Credentials{hosts[0]: {Username: "admin", Password: "secret"}, hosts[1]: {BearerToken: "token"}},
+		Interceptors: []Interceptor{func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				intercepted = append(intercepted, req.Header.Get("Authorization"))
+				return next.RoundTrip(req)
+			})
+		}}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster: %v", err)
+		return
+	}
+	defer cluster.Close()
+	for _, expected := range []string{"Basic YWRtaW46c2VjcmV0", "Bearer token", "Custom"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if expected == "Custom" {
+			req.Header.Set("Authorization", "Custom")
+		}
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if authorization := <-authorizations; authorization != expected {
+			t.Fatalf("Expected Authorization %q, got %q", expected, authorization)
+		}
+	}
+	if intercepted[0] != "" || intercepted[1] != "" {
+		t.Fatalf("Expected interceptors not to see the credentials, got %v", intercepted)
+	}
+	if formatted := fmt.Sprintf("%v %#v", config.Credentials, config.Credentials); strings.Contains(formatted, "secret") || strings.Contains(formatted, "token") {
+		t.Fatalf("Expected formatted credentials to be redacted, got %s", formatted)
+	}
+}
+
+func TestClusterSkipsKnownDeadNodesWithoutConnecting(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	// Accepts connections and closes them right away, failing every request sent to it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error when listening: %v", err)
+		return
+	}
+	defer listener.Close()
+	var connections atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Close()
+		}
+	}()
+	failing := listener.Addr().String()
+	config := &ClusterConfig{Hosts: []string{failing, hosts[0]}, Strategy: StrategyRoundRobin, BreakerThreshold: 1, BreakerCooldown: time.Hour,
+		IsNodeDead: func(resp *http.Response, err error) bool {
+			return err != nil
+		}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i<10; i++ {
+		if port := requestPort(t, cluster); port != ports[0] {
+			t.Fatalf("Expected request to be served by port %s, got %s", ports[0], port)
+			return
+		}
+	}
+	if connections.Load() != 1 {
+		t.Fatalf("Expected no connection to the node once its breaker opened, got %d connections", connections.Load())
+		return
+	}
+	t.Logf("--> Node with open breaker skipped")
+	// A snapshot taken before an eviction still lists the evicted node
+	state := cluster.snapshot()
+	node := findNode(state.nodes, hosts[0])
+	cluster.evict(node, errors.New("evicted"))
+	for i := 0; i<10; i++ {
+		if picked := state.config.selectNode(state.nodes, state.balancer, nil, nil); picked == node {
+			t.Fatalf("Expected the evicted node not to be selected from a stale snapshot")
+			return
+		}
+	}
+}
+
+func TestClusterRemovesNodesFailingTooManyReanimations(t *testing.T) {
+	ports, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	removed := make(chan string, 1)
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", hosts[0]}, Strategy: StrategyRoundRobin, NodeReanimationAfter: 10*time.Millisecond,
+		MaxReanimationAttempts: 2, OnNodePermanentlyRemoved: func(host string, err error) {
+			removed <- host
+		}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	deadline := time.After(5*time.Second)
+	for done := false; !done; {
+		select {
+		case host := <-removed:
+			if host != "localhost:324786" {
+				t.Fatalf("Expected the unreachable node to be removed, got %s", host)
+				return
+			}
+			done = true
+		case <-deadline:
+			t.Fatalf("Expected the unreachable node to be removed after failing its reanimations")
+			return
+		default:
+			if port := requestPort(t, cluster); port != ports[0] {
+				t.Fatalf("Expected request to be served by port %s, got %s", ports[0], port)
+				return
+			}
+			time.Sleep(5*time.Millisecond)
+		}
+	}
+	if live, dead := cluster.LiveHosts(), cluster.DeadHosts(); len(live) != 1 || len(dead) != 0 || len(cluster.CurrentConfig().Hosts) != 1 {
+		t.Fatalf("Expected the node to be removed for good, got live %v and dead %v", live, dead)
+		return
+	}
+	t.Logf("--> Node removed after failed reanimations")
+	cluster.UpdateWithConfig(config)
+	if live := cluster.LiveHosts(); len(live) != 2 {
+		t.Fatalf("Expected listing the host again to bring back the node, got %v", live)
+	}
+}
+
+func TestClusterReconfigurationCancelsPendingReanimation(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	reanimated := make(chan string, 10)
+	config := &ClusterConfig{Hosts: hosts, NodeReanimationAfter: 300*time.Millisecond, OnNodeReanimated: func(host string) {
+		reanimated <- host
+	}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	cluster.NodesMutex.RLock()
+	stale := findNode(cluster.Nodes, hosts[0])
+	cluster.NodesMutex.RUnlock()
+	cluster.evict(stale, errors.New("evicted"))
+	// The host is removed and listed again while the reanimation of its old node is pending
+	reduced := *config
+	reduced.Hosts = hosts[1:]
+	cluster.UpdateWithConfig(&reduced)
+	cluster.UpdateWithConfig(config)
+	cluster.NodesMutex.RLock()
+	fresh := findNode(cluster.Nodes, hosts[0])
+	cluster.NodesMutex.RUnlock()
+	if fresh == nil || fresh == stale {
+		t.Fatalf("Expected a fresh live node for the host listed again")
+		return
+	}
+	time.Sleep(100*time.Millisecond)
+	cluster.evict(fresh, errors.New("evicted"))
+	// The reanimation of the old node would be due now, the one of the fresh node is not
+	time.Sleep(250*time.Millisecond)
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != hosts[0] || stale.State() != NodeRemoved {
+		t.Fatalf("Expected the pending reanimation of the old node to be cancelled, got dead hosts %v", dead)
+		return
+	}
+	select {
+	case host := <-reanimated:
+		if host != hosts[0] || len(cluster.LiveHosts()) != 2 {
+			t.Fatalf("Expected the fresh node to be reanimated once, got %s and live hosts %v", host, cluster.LiveHosts())
+		}
+	case <-time.After(2*time.Second):
+		t.Fatalf("Expected the fresh node to be reanimated on its own schedule")
+	}
+	if len(reanimated) != 0 {
+		t.Fatalf("Expected a single reanimation, got %d more", len(reanimated))
+	}
+}
+
+func TestClusterForwardsCallersConnectionHeaderWithoutMutatingIt(t *testing.T) {
+	received := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer ts.Close()
+	host := ts.Listener.Addr().String()
+	config := &ClusterConfig{Hosts: []string{host}, DefaultHeaders: http.Header{"X-Default": {"1"}},
+		Credentials: map[string]Credentials{host: {BearerToken: "token"}}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("X-Hop", "forwarded")
+	resp, err := cluster.Do(req)
+	if err != nil {
+		t.Fatalf("Cluster client on Get request raised error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	header := <-received
+	if header.Get("Connection") != "keep-alive, X-Hop" || header.Get("X-Hop") != "forwarded" {
+		t.Fatalf("Expected the caller's connection options to be forwarded, got %v", header)
+	}
+	if header.Get("X-Default") != "1" || header.Get("Authorization") != "Bearer token" {
+		t.Fatalf("Expected default headers and credentials to be added, got %v", header)
+	}
+	if len(req.Header) != 2 || req.Header.Get("Connection") != "keep-alive, X-Hop" {
+		t.Fatalf("Expected the caller's header to be left untouched, got %v", req.Header)
+	}
+}
+
+func TestClusterEjectsNodesExceedingMaxLatency(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20*time.Millisecond)
+	}))
+	defer slow.Close()
+	slowHost := slow.Listener.Addr().String()
+	config := &ClusterConfig{Hosts: append(hosts, slowHost), Strategy: StrategyRoundRobin,
+		MaxLatency: 10*time.Millisecond, MaxLatencyWindow: 50*time.Millisecond, NodeReanimationAfterSeconds: 60}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i < 100 && len(cluster.DeadHosts()) == 0; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 1 || dead[0] != slowHost {
+		t.Fatalf("Expected the slow node to be ejected, got dead hosts %v", dead)
+	}
+	// The last node is kept however slow it is
+	config = &ClusterConfig{Hosts: []string{slowHost}, MaxLatency: 10*time.Millisecond,
+		MaxLatencyWindow: 50*time.Millisecond, MinHealthyNodes: 1}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	if dead := cluster.DeadHosts(); len(dead) != 0 {
+		t.Fatalf("Expected the slow node to be kept to stay at MinHealthyNodes, got dead hosts %v", dead)
+	}
+}
+
+func TestClusterWaitsUntilEnoughNodesAreHealthy(t *testing.T) {
+	var ready atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	host := ts.Listener.Addr().String()
+	config := &ClusterConfig{Hosts: []string{host, "localhost:324786"}, HealthCheckPath: "/health",
+		HealthCheckInterval: 20*time.Millisecond}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := cluster.WaitReady(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected waiting for an unhealthy cluster to time out, got %v", err)
+	}
+	if live := cluster.LiveHosts(); len(live) != 0 {
+		t.Fatalf("Expected nodes failing the health check to be evicted, got live hosts %v", live)
+	}
+	time.AfterFunc(50*time.Millisecond, func() {
+		ready.Store(true)
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.WaitReady(ctx, 1); err != nil {
+		t.Fatalf("Expected the cluster to turn ready, got %v", err)
+	}
+	if live := cluster.LiveHosts(); len(live) != 1 || live[0] != host {
+		t.Fatalf("Expected the healthy node to be live, got live hosts %v", live)
+	}
+	config = &ClusterConfig{Hosts: []string{host}}
+	cluster, err = NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if err := cluster.WaitReady(context.Background(), 1); err != ErrNoHealthCheck {
+		t.Fatalf("Expected ErrNoHealthCheck without health checks, got %v", err)
+	}
+}
+
+func TestClusterWaitReadyHonorsFailureThreshold(t *testing.T) {
+	var probes atomic.Int64
+	var failing atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first probe fails until failing is set
+		if probes.Add(1) == 1 || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	host := ts.Listener.Addr().String()
+	config := &ClusterConfig{Hosts: []string{host, hosts[0]}, HealthCheckPath: "/health",
+		HealthCheckInterval: 20*time.Millisecond, FailureThreshold: 2}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.WaitReady(ctx, 2); err != nil {
+		t.Fatalf("Expected the cluster to turn ready, got %v", err)
+		return
+	}
+	for len(cluster.Events()) > 0 {
+		if event := <-cluster.Events(); event.Type == EventNodeDead {
+			t.Fatalf("Expected a single failed probe below the failure threshold not to evict %s", event.Host)
+			return
+		}
+	}
+	if stats := cluster.Stats()[host]; stats.Failures != 0 {
+		t.Fatalf("Expected failed probes not to be counted as failed requests, got %d", stats.Failures)
+	}
+	failing.Store(true)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cluster.WaitReady(ctx, 2)
+	if live := cluster.LiveHosts(); len(live) != 1 || live[0] != hosts[0] {
+		t.Fatalf("Expected the node failing consecutive probes to be evicted, got live hosts %v", live)
+	}
+}
+
+func TestClusterDeliversNodeEvents(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 1)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: []string{hosts[0], "localhost:324786"}, Balancer: &lastNodeBalancer{},
+		NodeReanimationAfterSeconds: 60}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	requestPort(t, cluster)
+	cluster.RemoveHost("localhost:324786")
+	cluster.AddHost("localhost:324787")
+	expected := []NodeEvent{
+		{Type: EventNodeAdded, Host: hosts[0]},
+		{Type: EventNodeAdded, Host: "localhost:324786"},
+		{Type: EventNodeDead, Host: "localhost:324786"},
+		{Type: EventNodeRemoved, Host: "localhost:324786"},
+		{Type: EventNodeAdded, Host: "localhost:324787"},
+	}
+	for _, want := range expected {
+		select {
+		case event := <-cluster.Events():
+			if event.Type != want.Type || event.Host != want.Host || event.Time.IsZero() {
+				t.Fatalf("Expected %v event of %s, got %v event of %s", want.Type, want.Host, event.Type, event.Host)
+			}
+			if (event.Type == EventNodeDead) != (event.Err != nil) {
+				t.Fatalf("Expected only the dead event to carry an error, got %v with %v", event.Type, event.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %v event of %s", want.Type, want.Host)
+			return
+		}
+	}
+	if dropped := cluster.DroppedEvents(); dropped != 0 {
+		t.Fatalf("Expected no events to be dropped, got %d", dropped)
+	}
+}
+
+func TestClusterDropsEventsNobodyConsumes(t *testing.T) {
+	config := &ClusterConfig{Hosts: []string{"localhost:324786", "localhost:324787", "localhost:324788"}, EventBuffer: 1}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	if dropped := cluster.DroppedEvents(); dropped != 2 {
+		t.Fatalf("Expected the events exceeding the buffer to be dropped, got %d dropped", dropped)
+	}
+	if event := <-cluster.Events(); event.Type != EventNodeAdded || event.Host != "localhost:324786" {
+		t.Fatalf("Expected the first event to be kept, got %v event of %s", event.Type, event.Host)
+	}
+}
+
+func TestClusterCurrentConfigIsACopy(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 2)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts, Weights: map[string]int{hosts[0]: 2},
+		RetriableStatusCodes: []int{http.StatusBadGateway}}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	current := cluster.CurrentConfig()
+	current.Hosts[0] = "localhost:324786"
+	current.MaxRetries = -1
+	current.Weights["localhost:1"] = 99
+	if again := cluster.CurrentConfig(); again.Hosts[0] != hosts[0] || again.MaxRetries != 0 || len(again.Weights) != 1 {
+		t.Fatalf("Expected changes to the copy not to reach the cluster, got %+v", again)
+	}
+	// Neither does changing the config passed in after the update
+	config.Weights[hosts[1]] = 5
+	config.RetriableStatusCodes[0] = http.StatusInternalServerError
+	if again := cluster.CurrentConfig(); len(again.Weights) != 1 || again.RetriableStatusCodes[0] != http.StatusBadGateway {
+		t.Fatalf("Expected changes to the caller's config not to reach the cluster, got %+v", again)
+	}
+	if live := cluster.LiveHosts(); fmt.Sprint(live) != fmt.Sprint(hosts) {
+		t.Fatalf("Expected the nodes to stay untouched, got %v", live)
+	}
+}
+
+func TestClusterSerializesConcurrentUpdates(t *testing.T) {
+	_, hosts, servers := startTestServers(t, 4)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: hosts}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// Every update keeps the first host so requests always find a node
+				subset := []string{hosts[0], hosts[1 + (i + j) % 3]}
+				cluster.UpdateWithConfig(&ClusterConfig{Hosts: subset, Strategy: StrategyRoundRobin})
+				if j % 10 == 0 {
+					cluster.AddHost(hosts[3])
+					cluster.RemoveHost(hosts[2])
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req, _ := http.NewRequest("GET", "/", nil)
+				resp, err := cluster.Do(req)
+				if err != nil {
+					t.Errorf("Cluster client on Get request raised error: %v", err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	// Each configured host has exactly one node and no node is left without its host
+	configured := cluster.CurrentConfig().Hosts
+	nodes := append(cluster.LiveHosts(), cluster.DeadHosts()...)
+	sort.Strings(configured)
+	sort.Strings(nodes)
+	if fmt.Sprint(configured) != fmt.Sprint(nodes) {
+		t.Fatalf("Expected the nodes to match the configured hosts %v, got %v", configured, nodes)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	config, err := LoadConfigJSON(strings.NewReader(`{
+		"hosts": ["localhost:8080", "localhost:8081"],
+		"strategy": "round-robin",
+		"weights": {"localhost:8080": 3},
+		"tiers": {"localhost:8081": 1},
+		"attemptTimeout": "250ms",
+		"nodeReanimationAfter": "1m"
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error when loading config: %v", err)
+		return
+	}
+	if len(config.Hosts) != 2 || config.Strategy != StrategyRoundRobin || config.Weights["localhost:8080"] != 3 ||
+		config.Tiers["localhost:8081"] != 1 || config.AttemptTimeout != 250*time.Millisecond || config.NodeReanimationAfter != time.Minute {
+		t.Fatalf("Expected the settings of the file, got %+v", config)
+	}
+	invalid := map[string]string{
+		`{"hosts": ["localhost:8080"], "timeout": "1s"}`: `unknown field "timeout"`,
+		`{"hosts": ["localhost:8080"], "dialTimeout": "soon"}`: `Invalid dialTimeout "soon"`,
+		`{"hosts": ["localhost:8080"], "backoffBase": "-1s"}`: `Invalid backoffBase "-1s": duration is negative`,
+		`{"hosts": ["localhost:8080"], "strategy": "fastest"}`: `Invalid strategy "fastest"`,
+		`{"hosts": ["localhost:8080"], "weights": {"localhost:8080": -1}}`: `Invalid weight -1`,
+		`{"hosts": ["localhost"]}`: `Invalid host "localhost"`,
+		`{"hosts": []}`: ErrNoHosts.Error(),
+		`{"hosts": "localhost:8080"}`: `Invalid cluster config`,
+	}
+	for input, expected := range invalid {
+		if _, err := LoadConfigJSON(strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected error containing `%s` for %s, got %v", expected, input, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cluster
+
+import(
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNodesSaturated = errors.New("All cluster nodes are at their concurrency limit")
+
+// Takes one of the limit concurrent request slots of the node if one is free
+func(node *Node) acquireSlot(limit int) bool {
+	for {
+		slots := node.slots.Load()
+		if slots >= int64(limit) {
+			return false
+		}
+		if node.slots.CompareAndSwap(slots, slots+1) {
+			return true
+		}
+	}
+}
+
+func(node *Node) saturated(limit int) bool {
+	return limit > 0 && node.slots.Load() >= int64(limit)
+}
+
+// Frees a slot of the node and wakes up the requests queued for one
+func(cluster *Cluster) releaseSlot(node *Node) {
+	node.slots.Add(-1)
+	cluster.slotMutex.Lock()
+	defer cluster.slotMutex.Unlock()
+	if cluster.slotFreed != nil {
+		close(cluster.slotFreed)
+		cluster.slotFreed = nil
+	}
+}
+
+// Closed once the next slot of any node is freed
+func(cluster *Cluster) slotReleased() <-chan struct{} {
+	cluster.slotMutex.Lock()
+	defer cluster.slotMutex.Unlock()
+	if cluster.slotFreed == nil {
+		cluster.slotFreed = make(chan struct{})
+	}
+	return cluster.slotFreed
+}
+
+// Waits for a node skipped only for being saturated to free a slot, until the deadline at most.
+// Returns false if there is no such node and ErrNodesSaturated if the deadline passed.
+func(cluster *Cluster) waitForSlot(ctx context.Context, nodes []*Node, skip func(*Node) bool, limit int, deadline time.Time) (bool, error) {
+	freed := cluster.slotReleased()
+	waiting := false
+	for _, node := range nodes {
+		if skip != nil && skip(node) {
+			continue
+		}
+		if !node.saturated(limit) {
+			// A slot was freed since the selection
+			return true, nil
+		}
+		waiting = true
+	}
+	if !waiting {
+		return false, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return false, ErrNodesSaturated
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-freed:
+		return true, nil
+	case <-timer.C:
+		return false, ErrNodesSaturated
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+var ErrClusterSaturated = errors.New("Cluster reached its limit of requests in flight")
+
+// Counting semaphore whose limit may change between acquisitions
+type semaphore struct {
+	count 	atomic.Int64
+	mutex 	sync.Mutex
+	// Closed and replaced whenever a slot is freed
+	freed 	chan struct{}
+}
+
+func(semaphore *semaphore) tryAcquire(limit int) bool {
+	for {
+		count := semaphore.count.Load()
+		if count >= int64(limit) {
+			return false
+		}
+		if semaphore.count.CompareAndSwap(count, count+1) {
+			return true
+		}
+	}
+}
+
+// Blocks until a slot is free or the context is done
+func(semaphore *semaphore) acquire(ctx context.Context, limit int) error {
+	for {
+		freed := semaphore.released()
+		if semaphore.tryAcquire(limit) {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func(semaphore *semaphore) release() {
+	semaphore.count.Add(-1)
+	semaphore.mutex.Lock()
+	defer semaphore.mutex.Unlock()
+	if semaphore.freed != nil {
+		close(semaphore.freed)
+		semaphore.freed = nil
+	}
+}
+
+// Closed once the next slot is freed
+func(semaphore *semaphore) released() <-chan struct{} {
+	semaphore.mutex.Lock()
+	defer semaphore.mutex.Unlock()
+	if semaphore.freed == nil {
+		semaphore.freed = make(chan struct{})
+	}
+	return semaphore.freed
+}
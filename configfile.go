@@ -0,0 +1,127 @@
+package cluster
+
+import(
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FileConfig is the declarative part of a ClusterConfig as kept in a file and read by
+// LoadConfigJSON. Durations are given as strings like "500ms" or "2m", empty ones keep the
+// defaults.
+type FileConfig struct {
+	Hosts 						[]string 			`json:"hosts" yaml:"hosts"`
+	Strategy 					string 				`json:"strategy" yaml:"strategy"`
+	Weights 					map[string]int 		`json:"weights" yaml:"weights"`
+	Tiers 						map[string]int 		`json:"tiers" yaml:"tiers"`
+	Zones 						map[string]string 	`json:"zones" yaml:"zones"`
+	LocalZone 					string 				`json:"localZone" yaml:"localZone"`
+	Groups 						map[string]string 	`json:"groups" yaml:"groups"`
+	PathGroups 					map[string]string 	`json:"pathGroups" yaml:"pathGroups"`
+	Roles 						map[string]string 	`json:"roles" yaml:"roles"`
+	Scheme 						string 				`json:"scheme" yaml:"scheme"`
+	MaxRetries 					int 				`json:"maxRetries" yaml:"maxRetries"`
+	RetriableStatusCodes 		[]int 				`json:"retriableStatusCodes" yaml:"retriableStatusCodes"`
+	AllowNonIdempotentRetry 	bool 				`json:"allowNonIdempotentRetry" yaml:"allowNonIdempotentRetry"`
+	FailureThreshold 			int 				`json:"failureThreshold" yaml:"failureThreshold"`
+	MinHealthyNodes 			int 				`json:"minHealthyNodes" yaml:"minHealthyNodes"`
+	HealthCheckPath 			string 				`json:"healthCheckPath" yaml:"healthCheckPath"`
+	NodeReanimationAfter 		string 				`json:"nodeReanimationAfter" yaml:"nodeReanimationAfter"`
+	MaxReanimationAfter 		string 				`json:"maxReanimationAfter" yaml:"maxReanimationAfter"`
+	HealthCheckInterval 		string 				`json:"healthCheckInterval" yaml:"healthCheckInterval"`
+	HealthCheckTimeout 			string 				`json:"healthCheckTimeout" yaml:"healthCheckTimeout"`
+	AttemptTimeout 				string 				`json:"attemptTimeout" yaml:"attemptTimeout"`
+	DialTimeout 				string 				`json:"dialTimeout" yaml:"dialTimeout"`
+	BackoffBase 				string 				`json:"backoffBase" yaml:"backoffBase"`
+	BackoffMax 					string 				`json:"backoffMax" yaml:"backoffMax"`
+	DrainTimeout 				string 				`json:"drainTimeout" yaml:"drainTimeout"`
+	MaxLatency 					string 				`json:"maxLatency" yaml:"maxLatency"`
+}
+
+// Reads a FileConfig in JSON and turns it into a validated ClusterConfig. Unknown fields are
+// rejected so misspelt settings do not go unnoticed.
+func LoadConfigJSON(r io.Reader) (*ClusterConfig, error) {
+	var file FileConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("Invalid cluster config: %v", err)
+	}
+	return file.ClusterConfig()
+}
+
+// ClusterConfig turns the file config into a ClusterConfig and validates it, reporting the
+// first malformed setting
+func(file *FileConfig) ClusterConfig() (*ClusterConfig, error) {
+	config := &ClusterConfig{
+		Hosts: file.Hosts,
+		Strategy: file.Strategy,
+		Weights: file.Weights,
+		Tiers: file.Tiers,
+		Zones: file.Zones,
+		LocalZone: file.LocalZone,
+		Groups: file.Groups,
+		PathGroups: file.PathGroups,
+		Roles: file.Roles,
+		Scheme: file.Scheme,
+		MaxRetries: file.MaxRetries,
+		RetriableStatusCodes: file.RetriableStatusCodes,
+		AllowNonIdempotentRetry: file.AllowNonIdempotentRetry,
+		FailureThreshold: file.FailureThreshold,
+		MinHealthyNodes: file.MinHealthyNodes,
+		HealthCheckPath: file.HealthCheckPath,
+	}
+	durations := []struct {
+		name 	string
+		value 	string
+		target 	*time.Duration
+	}{
+		{"nodeReanimationAfter", file.NodeReanimationAfter, &config.NodeReanimationAfter},
+		{"maxReanimationAfter", file.MaxReanimationAfter, &config.MaxReanimationAfter},
+		{"healthCheckInterval", file.HealthCheckInterval, &config.HealthCheckInterval},
+		{"healthCheckTimeout", file.HealthCheckTimeout, &config.HealthCheckTimeout},
+		{"attemptTimeout", file.AttemptTimeout, &config.AttemptTimeout},
+		{"dialTimeout", file.DialTimeout, &config.DialTimeout},
+		{"backoffBase", file.BackoffBase, &config.BackoffBase},
+		{"backoffMax", file.BackoffMax, &config.BackoffMax},
+		{"drainTimeout", file.DrainTimeout, &config.DrainTimeout},
+		{"maxLatency", file.MaxLatency, &config.MaxLatency},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %v", duration.name, duration.value, err)
+		}
+		if parsed < 0 {
+			return nil, fmt.Errorf("Invalid %s %q: duration is negative", duration.name, duration.value)
+		}
+		*duration.target = parsed
+	}
+	switch config.Strategy {
+	case "", StrategyRandom, StrategyRoundRobin, StrategyLeastConnections, StrategyConsistentHash,
+		StrategyPowerOfTwoChoices, StrategyLatency, StrategyStickySession:
+	default:
+		return nil, fmt.Errorf("Invalid strategy %q", config.Strategy)
+	}
+	switch config.Scheme {
+	case "", "http", "https":
+	default:
+		return nil, fmt.Errorf("Invalid scheme %q: must be http or https", config.Scheme)
+	}
+	for host, weight := range config.Weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("Invalid weight %d of host %q: weight is negative", weight, host)
+		}
+	}
+	if config.LocalZone != "" && len(config.Zones) == 0 {
+		return nil, fmt.Errorf("Invalid localZone %q: no zones assigned", config.LocalZone)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
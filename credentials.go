@@ -0,0 +1,54 @@
+package cluster
+
+import(
+	"net/http"
+)
+
+// Credentials a node authenticates requests with, either basic auth or a bearer token. They are
+// redacted when formatted so they do not end up in logs.
+type Credentials struct {
+	Username 		string
+	Password 		string
+	BearerToken 	string
+}
+
+func(credentials Credentials) String() string {
+	switch {
+	case credentials.BearerToken != "":
+		return "Bearer [redacted]"
+	case credentials.Username != "" || credentials.Password != "":
+		return "Basic " + credentials.Username + ":[redacted]"
+	}
+	return "none"
+}
+
+func(credentials Credentials) GoString() string {
+	return "cluster.Credentials{" + credentials.String() + "}"
+}
+
+func(config *ClusterConfig) credentials(host string) *Credentials {
+	credentials, ok := config.Credentials[host]
+	if !ok {
+		return nil
+	}
+	return &credentials
+}
+
+// Returns the request authenticated with the credentials on a copy with its own header, requests
+// carrying an Authorization header already are left untouched
+func withCredentials(req *http.Request, credentials *Credentials) *http.Request {
+	if credentials == nil || req.Header.Get("Authorization") != "" {
+		return req
+	}
+	authenticated := *req
+	authenticated.Header = req.Header.Clone()
+	if authenticated.Header == nil {
+		authenticated.Header = http.Header{}
+	}
+	if credentials.BearerToken != "" {
+		authenticated.Header.Set("Authorization", "Bearer " + credentials.BearerToken)
+	} else {
+		authenticated.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+	return &authenticated
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import(
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval SRV records are resolved again at if ResolveInterval is not set
+const DefaultResolveInterval = 30 * time.Second
+
+func(config *ClusterConfig) resolving() bool {
+	return config.ResolveInterval > 0 || config.SRVService != ""
+}
+
+func(config *ClusterConfig) resolveInterval() time.Duration {
+	if config.ResolveInterval > 0 {
+		return config.ResolveInterval
+	}
+	return DefaultResolveInterval
+}
+
+func(config *ClusterConfig) lookupSRV(ctx context.Context, name string) (records []*net.SRV, err error) {
+	if config.LookupSRV != nil {
+		err = errCallbackPanicked
+		config.callback("LookupSRV", func() {
+			records, err = config.LookupSRV(ctx, name)
+		})
+		return
+	}
+	_, records, err = net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return
+}
+
+func(config *ClusterConfig) lookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	if config.LookupHost != nil {
+		err = errCallbackPanicked
+		config.callback("LookupHost", func() {
+			addrs, err = config.LookupHost(ctx, host)
+		})
+		return
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// Resolves the names of the configured hosts and the SRV records, hosts and records failing to
+// resolve keep their previous addresses
+func(cluster *Cluster) resolve(ctx context.Context, config *ClusterConfig) {
+	var srvRecords []*net.SRV
+	srvResolved := config.SRVService == ""
+	if !srvResolved {
+		records, err := config.lookupSRV(ctx, config.SRVService)
+		if err != nil {
+			config.logger().Printf("Cluster failed to resolve SRV records of %s: %v", config.SRVService, err)
+		} else {
+			srvRecords, srvResolved = records, true
+		}
+	}
+	resolved := make(map[string][]string, len(config.Hosts))
+	var failed []string
+	for _, host := range uniqueHosts(config.Hosts) {
+		if config.ResolveInterval <= 0 {
+			break
+		}
+		name, port, err := net.SplitHostPort(host)
+		if err != nil || net.ParseIP(name) != nil {
+			continue
+		}
+		addrs, err := config.lookupHost(ctx, name)
+		if err != nil || len(addrs) == 0 {
+			config.logger().Printf("Cluster failed to resolve host %s: %v", host, err)
+			failed = append(failed, host)
+			continue
+		}
+		for _, addr := range addrs {
+			resolved[host] = append(resolved[host], net.JoinHostPort(addr, port))
+		}
+	}
+	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
+	for _, host := range failed {
+		if addrs, ok := cluster.resolved[host]; ok {
+			resolved[host] = addrs
+		}
+	}
+	cluster.resolved = resolved
+	if srvResolved {
+		cluster.srvRecords = srvRecords
+	}
+}
+
+func srvHost(record *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+}
+
+// Marks the nodes of SRV targets with the priority and weight of their record and returns whether
+// any of those changed. The caller must hold the NodesMutex and DeadPoolMutex.
+func(cluster *Cluster) applySRV() bool {
+	records := make(map[string]*net.SRV, len(cluster.srvRecords))
+	for _, record := range cluster.srvRecords {
+		records[srvHost(record)] = record
+	}
+	changed := false
+	for _, nodes := range [][]*Node{cluster.Nodes, cluster.DeadPool} {
+		for _, node := range nodes {
+			record, srv := records[node.Host]
+			priority, weight := int64(0), int64(0)
+			if srv {
+				priority, weight = int64(record.Priority), int64(record.Weight)
+			}
+			if node.srv.Swap(srv) != srv {
+				changed = true
+			}
+			if node.srvPriority.Swap(priority) != priority {
+				changed = true
+			}
+			if node.srvWeight.Swap(weight) != weight {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// Addresses of the hosts as last resolved followed by the SRV targets, hosts never resolved are
+// kept as they are. The caller must hold the NodesMutex.
+func(cluster *Cluster) resolvedHosts(config *ClusterConfig, hosts []string) []string {
+	nodeHosts := make([]string, 0, len(hosts) + len(cluster.srvRecords))
+	for _, host := range hosts {
+		if addrs, ok := cluster.resolved[host]; ok && config.ResolveInterval > 0 {
+			nodeHosts = append(nodeHosts, addrs...)
+		} else {
+			nodeHosts = append(nodeHosts, host)
+		}
+	}
+	if config.SRVService != "" {
+		for _, record := range cluster.srvRecords {
+			nodeHosts = append(nodeHosts, srvHost(record))
+		}
+	}
+	return uniqueHosts(nodeHosts)
+}
+
+// Periodically resolves the configured hosts and reconciles the nodes with their addresses until
+// ctx is done
+func(cluster *Cluster) runResolver(ctx context.Context) {
+	for {
+		cluster.NodesMutex.RLock()
+		config := cluster.config
+		cluster.NodesMutex.RUnlock()
+		if !config.resolving() {
+			return
+		}
+		timer := time.NewTimer(config.resolveInterval())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		cluster.resolveAndReconcile(ctx)
+	}
+}
+
+// Resolves the hosts of the current config and reconciles the nodes with their addresses
+func(cluster *Cluster) resolveAndReconcile(ctx context.Context) {
+	cluster.updateMutex.Lock()
+	defer cluster.updateMutex.Unlock()
+	cluster.NodesMutex.RLock()
+	config := cluster.config
+	cluster.NodesMutex.RUnlock()
+	if !config.resolving() {
+		return
+	}
+	cluster.resolve(ctx, &config)
+	cluster.NodesMutex.Lock()
+	defer cluster.NodesMutex.Unlock()
+	cluster.DeadPoolMutex.Lock()
+	defer cluster.DeadPoolMutex.Unlock()
+	// Hosts may have been added or removed while resolving
+	cluster.reconcile(&cluster.config, cluster.resolvedHosts(&cluster.config, cluster.config.Hosts))
+	if cluster.applySRV() {
+		// Weighted balancers cache the weights of the nodes they were built for
+		cluster.renewBalancer(&cluster.config)
+	}
+	cluster.publish()
+}
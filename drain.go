@@ -0,0 +1,78 @@
+package cluster
+
+import(
+	"context"
+	"time"
+)
+
+// Time removed nodes get to finish their requests in flight by default
+const DefaultDrainTimeout = 30 * time.Second
+
+// Interval the requests in flight of a draining node are checked at
+const drainPollInterval = 10 * time.Millisecond
+
+func(config *ClusterConfig) drainTimeout() time.Duration {
+	if config.DrainTimeout > 0 {
+		return config.DrainTimeout
+	}
+	return DefaultDrainTimeout
+}
+
+// Closes the idle connections of the node unless it shares its transport with the cluster, whose
+// connections to the other nodes would be closed as well
+func(cluster *Cluster) closeIdleConnections(node *Node) {
+	if node.Client != nil && node.Client.Transport != cluster.Client.Transport {
+		node.Client.CloseIdleConnections()
+	}
+}
+
+// Lets nodes removed from the cluster finish their requests in flight up to the timeout and then
+// closes their idle connections. The nodes no longer receive new requests. The caller must hold
+// the NodesMutex.
+func(cluster *Cluster) drain(nodes []*Node, timeout time.Duration) {
+	if len(nodes) == 0 {
+		return
+	}
+	for _, node := range nodes {
+		node.setState(NodeDraining)
+	}
+	logger := cluster.config.logger()
+	finish := func(node *Node) {
+		node.setState(NodeRemoved)
+		cluster.closeIdleConnections(node)
+		logger.Printf("Cluster drained node %s", node.Host)
+	}
+	started := cluster.goBackground(func(ctx context.Context) {
+		deadline := time.Now().Add(timeout)
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		pending := nodes
+		for len(pending) > 0 {
+			remaining := pending[:0:0]
+			for _, node := range pending {
+				if node.InFlight() == 0 || time.Now().After(deadline) {
+					finish(node)
+				} else {
+					remaining = append(remaining, node)
+				}
+			}
+			pending = remaining
+			if len(pending) == 0 {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				for _, node := range pending {
+					finish(node)
+				}
+				return
+			}
+		}
+	})
+	if !started {
+		for _, node := range nodes {
+			finish(node)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cluster
+
+import(
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNoNodesAvailable = errors.New("No cluster nodes available")
+
+// A failed attempt to forward a request to a node
+type NodeAttempt struct {
+	Host 	string
+	Err 	error
+}
+
+// AllNodesUnavailableError is returned when no node is left to forward a request to. It lists
+// every node attempted for the request along with the reason it failed and matches
+// ErrNoNodesAvailable with errors.Is. Its message is the one of ErrNoNodesAvailable, Details
+// adds the failures of the attempts.
+type AllNodesUnavailableError struct {
+	Attempts 	[]NodeAttempt
+}
+
+func(err *AllNodesUnavailableError) Error() string {
+	return ErrNoNodesAvailable.Error()
+}
+
+// Message listing the failure of every attempted node, e.g. for logging
+func(err *AllNodesUnavailableError) Details() string {
+	var builder strings.Builder
+	builder.WriteString(ErrNoNodesAvailable.Error())
+	for idx, attempt := range err.Attempts {
+		if idx == 0 {
+			builder.WriteString(": ")
+		} else {
+			builder.WriteString("; ")
+		}
+		builder.WriteString(attempt.Host)
+		builder.WriteString(": ")
+		builder.WriteString(attempt.Err.Error())
+	}
+	return builder.String()
+}
+
+func(err *AllNodesUnavailableError) Is(target error) bool {
+	return target == ErrNoNodesAvailable
+}
+
+func(err *AllNodesUnavailableError) Unwrap() []error {
+	errs := make([]error, 0, len(err.Attempts))
+	for _, attempt := range err.Attempts {
+		errs = append(errs, attempt.Err)
+	}
+	return errs
+}
+
+// Joins the errors of the failed attempts, each prefixed with the host of its node
+func attemptsError(attempts []NodeAttempt) error {
+	errs := make([]error, 0, len(attempts))
+	for _, attempt := range attempts {
+		errs = append(errs, fmt.Errorf("%s: %w", attempt.Host, attempt.Err))
+	}
+	return errors.Join(errs...)
+}
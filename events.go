@@ -0,0 +1,75 @@
+package cluster
+
+import(
+	"time"
+)
+
+// Capacity of the channel returned by Cluster.Events by default
+const DefaultEventBuffer = 64
+
+type NodeEventType int
+
+const (
+	// The node was evicted to the dead pool
+	EventNodeDead NodeEventType = iota
+	// The node was moved from the dead pool back to the live nodes
+	EventNodeReanimated
+	// A node was created for a host added to the cluster
+	EventNodeAdded
+	// The node was removed from the cluster, either as its host is no longer listed or for
+	// failing too many reanimations
+	EventNodeRemoved
+)
+
+func(eventType NodeEventType) String() string {
+	switch eventType {
+	case EventNodeDead:
+		return "dead"
+	case EventNodeReanimated:
+		return "reanimated"
+	case EventNodeAdded:
+		return "added"
+	case EventNodeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// Transition of a node delivered by Cluster.Events
+type NodeEvent struct {
+	Type 	NodeEventType
+	Host 	string
+	Time 	time.Time
+	// Err is the failure a node was evicted or permanently removed for, nil otherwise
+	Err 	error
+}
+
+// Events delivers the transitions of the nodes in the order they happened, starting with the
+// nodes added on creation. The channel is buffered with EventBuffer events. The cluster never
+// waits for a consumer: once the buffer is full further events are dropped and counted by
+// DroppedEvents, so a slow consumer misses events but does not stall requests. The channel is
+// shared by all callers and never closed.
+func(cluster *Cluster) Events() <-chan NodeEvent {
+	return cluster.events
+}
+
+// Number of events dropped since the cluster was created as the buffer of Events was full
+func(cluster *Cluster) DroppedEvents() int64 {
+	return cluster.droppedEvents.Load()
+}
+
+func(config *ClusterConfig) eventBuffer() int {
+	if config.EventBuffer <= 0 {
+		return DefaultEventBuffer
+	}
+	return config.EventBuffer
+}
+
+// Delivers the event unless the buffer is full, never blocking
+func(cluster *Cluster) emit(eventType NodeEventType, host string, err error) {
+	select {
+	case cluster.events <- NodeEvent{Type: eventType, Host: host, Time: time.Now(), Err: err}:
+	default:
+		cluster.droppedEvents.Add(1)
+	}
+}
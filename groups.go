@@ -0,0 +1,50 @@
+package cluster
+
+import(
+	"context"
+	"net/http"
+	"time"
+)
+
+type groupKey struct {}
+
+// DoGroup works like Do but sends the request to and fails over within the nodes of the named
+// group only, regardless of ClusterConfig.PathGroups. Hosts missing from ClusterConfig.Groups
+// form DefaultGroup.
+func(cluster *Cluster) DoGroup(name string, req *http.Request) (*http.Response, error) {
+	return cluster.Do(req.WithContext(context.WithValue(req.Context(), groupKey{}, name)))
+}
+
+// Group the request was sent to with DoGroup
+func requestGroup(req *http.Request) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+	group, ok := req.Context().Value(groupKey{}).(string)
+	return group, ok
+}
+
+// Delay after which the evicted node is put back into rotation, the one of its group if set in
+// GroupReanimationAfter
+func(config *ClusterConfig) nodeReanimationDelay(node *Node) time.Duration {
+	if delay, ok := config.GroupReanimationAfter[config.group(node)]; ok && delay > 0 {
+		return delay
+	}
+	return config.reanimationDelay()
+}
+
+// Stats of all live and dead nodes by group and host
+func(cluster *Cluster) GroupStats() map[string]map[string]NodeStats {
+	cluster.NodesMutex.RLock()
+	config := cluster.config
+	cluster.NodesMutex.RUnlock()
+	groups := map[string]map[string]NodeStats{}
+	for host, stats := range cluster.Stats() {
+		group := config.group(&Node{Host: host})
+		if groups[group] == nil {
+			groups[group] = map[string]NodeStats{}
+		}
+		groups[group][host] = stats
+	}
+	return groups
+}
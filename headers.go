@@ -0,0 +1,30 @@
+package cluster
+
+import(
+	"net/http"
+)
+
+// Returns the request with the DefaultHeaders it does not set yet, on a copy with its own header
+// so the caller's request is left untouched
+func(config *ClusterConfig) withDefaultHeaders(req *http.Request) *http.Request {
+	var header http.Header
+	for key, values := range config.DefaultHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := req.Header[key]; ok {
+			continue
+		}
+		if header == nil {
+			header = req.Header.Clone()
+			if header == nil {
+				header = http.Header{}
+			}
+		}
+		header[key] = append([]string(nil), values...)
+	}
+	if header == nil {
+		return req
+	}
+	withHeaders := *req
+	withHeaders.Header = header
+	return &withHeaders
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// Longest time WaitReady waits between two checks of the nodes
+const maxReadyCheckInterval = time.Second
+
+// Returned by Cluster.WaitReady for clusters without HealthCheckPath
+var ErrNoHealthCheck = errors.New("Cluster has no health check configured")
+
+// Periodically probes the dead nodes and reanimates those passing the check until ctx is done
+func(cluster *Cluster) runHealthChecks(ctx context.Context) {
+	for {
+		cluster.NodesMutex.RLock()
+		config := cluster.config
+		cluster.NodesMutex.RUnlock()
+		timer := time.NewTimer(config.healthCheckInterval())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		cluster.checkDeadNodes(ctx, &config)
+	}
+}
+
+func(config *ClusterConfig) healthCheckInterval() time.Duration {
+	if config.HealthCheckInterval > 0 {
+		return config.HealthCheckInterval
+	}
+	return DefaultHealthCheckInterval
+}
+
+func(config *ClusterConfig) healthCheckTimeout() time.Duration {
+	if config.HealthCheckTimeout > 0 {
+		return config.HealthCheckTimeout
+	}
+	if config.HealthCheckInterval > 0 {
+		return config.HealthCheckInterval
+	}
+	return DefaultHealthCheckInterval
+}
+
+// Probes all dead nodes not backed off concurrently so one hanging node does not delay the others
+func(cluster *Cluster) checkDeadNodes(ctx context.Context, config *ClusterConfig) {
+	cluster.DeadPoolMutex.RLock()
+	deadNodes := cluster.DeadPool
+	cluster.DeadPoolMutex.RUnlock()
+	var wg sync.WaitGroup
+	for _, node := range deadNodes {
+		if !node.probeDue() {
+			continue
+		}
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			// The transport and the logging of the reanimation run user code
+			config.callback("health check", func() {
+				ctx, cancel := context.WithTimeout(ctx, config.healthCheckTimeout())
+				defer cancel()
+				if CheckNodeHealth(ctx, node, config.HealthCheckPath) {
+					cluster.reanimate(node)
+				}
+			})
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Reports whether a dead node relapsing within MaxReanimationAfter was backed off long enough
+// to be probed again
+func(node *Node) probeDue() bool {
+	return time.Now().UnixNano() >= node.probeAfter.Load()
+}
+
+// Reports whether a GET request for the path on the node responds 200 before ctx is done
+func CheckNodeHealth(ctx context.Context, node *Node, path string) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := node.Do(req)
+	if err != nil {
+		return false
+	}
+	discardResponse(resp)
+	return resp.StatusCode == http.StatusOK
+}
+
+// WaitReady blocks until at least minHealthy nodes pass the health check at HealthCheckPath, at
+// least one, or ctx is done. Live nodes failing the check count the failure towards their
+// FailureThreshold like failed requests do and dead nodes passing it are reanimated. The nodes
+// are checked again every HealthCheckInterval, at most every second, until enough of them pass.
+func(cluster *Cluster) WaitReady(ctx context.Context, minHealthy int) error {
+	if minHealthy < 1 {
+		minHealthy = 1
+	}
+	for {
+		if cluster.ctx.Err() != nil {
+			return ErrClusterClosed
+		}
+		config := cluster.snapshot().config
+		if config.HealthCheckPath == "" {
+			return ErrNoHealthCheck
+		}
+		healthy := cluster.checkAllNodes(ctx, config)
+		if healthy >= minHealthy {
+			return nil
+		}
+		interval := config.HealthCheckInterval
+		if interval <= 0 || interval > maxReadyCheckInterval {
+			interval = maxReadyCheckInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("Cluster has %d of %d healthy nodes: %w", healthy, minHealthy, ctx.Err())
+		}
+	}
+}
+
+// Probes the live and dead nodes concurrently, counting the failures of the live ones and
+// reanimating the dead ones passing, and returns the number of nodes passing
+func(cluster *Cluster) checkAllNodes(ctx context.Context, config *ClusterConfig) int {
+	cluster.NodesMutex.RLock()
+	nodes := append([]*Node{}, cluster.Nodes...)
+	cluster.NodesMutex.RUnlock()
+	cluster.DeadPoolMutex.RLock()
+	for _, node := range cluster.DeadPool {
+		if node.probeDue() {
+			nodes = append(nodes, node)
+		}
+	}
+	cluster.DeadPoolMutex.RUnlock()
+	var healthy atomic.Int64
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			config.callback("health check", func() {
+				checkCtx, cancel := context.WithTimeout(ctx, config.healthCheckTimeout())
+				defer cancel()
+				switch {
+				case CheckNodeHealth(checkCtx, node, config.HealthCheckPath):
+					healthy.Add(1)
+					if node.State() == NodeDead {
+						cluster.reanimate(node)
+					} else {
+						node.consecutiveFailures.Store(0)
+						node.state.CompareAndSwap(int32(NodeSuspect), int32(NodeHealthy))
+					}
+				case ctx.Err() == nil && node.State() != NodeDead:
+					cluster.countFailure(config, node, fmt.Errorf("Node %s failed the health check", node.Host))
+				}
+			})
+		}(node)
+	}
+	wg.Wait()
+	return int(healthy.Load())
+}
@@ -0,0 +1,124 @@
+package cluster
+
+import(
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+type hedgeResult struct {
+	node 	*Node
+	resp 	*http.Response
+	err 	error
+}
+
+// Closes the response body and then cancels the context of the request it belongs to
+type cancelBody struct {
+	io.ReadCloser
+	cancel 	context.CancelFunc
+}
+
+func(body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// Sends the request to the node and, once it did not respond within HedgeAfter, also to the
+// node pickHedge returns, reporting it to hedged once the request is on its way and to release
+// once the node responded or was not sent the request after all. The first successful response,
+// i.e. one without error and a status below 500, wins while the other request is cancelled and
+// its response closed. If every request fails the outcome of the first node is returned.
+func(config *ClusterConfig) hedge(req *http.Request, node *Node, pickHedge func() *Node, hedged func(*Node), release func(*Node)) (*http.Response, *Node, error) {
+	results := make(chan hedgeResult, 2)
+	cancels := map[*Node]context.CancelFunc{}
+	launch := func(node *Node, body io.ReadCloser) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[node] = cancel
+		nodeReq := req.Clone(ctx)
+		nodeReq.Body = body
+		go func() {
+			result := hedgeResult{node: node, err: errCallbackPanicked}
+			defer func() {
+				release(node)
+				results <- result
+			}()
+			config.callback("hedged request", func() {
+				result.resp, result.err = config.doNode(node, nodeReq)
+			})
+		}()
+	}
+	// Releases a request that did not win
+	discard := func(result hedgeResult) {
+		cancels[result.node]()
+		discardResponse(result.resp)
+		if config.BreakerThreshold > 0 {
+			result.node.breaker.release()
+		}
+	}
+	launch(node, req.Body)
+	timer := time.NewTimer(config.HedgeAfter)
+	defer timer.Stop()
+	hedgeTimer := timer.C
+	var first *hedgeResult
+	for pending := 1; pending > 0; {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if req.Context().Err() != nil {
+				continue
+			}
+			if hedgeNode := pickHedge(); hedgeNode != nil {
+				if hedgeReq, err := rewindBody(req); err == nil {
+					launch(hedgeNode, hedgeReq.Body)
+					hedged(hedgeNode)
+					pending++
+				} else {
+					release(hedgeNode)
+					if config.BreakerThreshold > 0 {
+						hedgeNode.breaker.release()
+					}
+				}
+			}
+		case result := <-results:
+			pending--
+			// No hedge is launched after a result arrived: a node failing before HedgeAfter is
+			// failed over like any failed attempt, while a hedge already on its way may still
+			// succeed
+			hedgeTimer = nil
+			if result.err == nil && result.resp.StatusCode < 500 {
+				for other, cancel := range cancels {
+					if other != result.node {
+						cancel()
+					}
+				}
+				if first != nil {
+					discard(*first)
+				}
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						discard(<-results)
+					}
+				}(pending)
+				result.resp.Body = &cancelBody{ReadCloser: result.resp.Body, cancel: cancels[result.node]}
+				return result.resp, result.node, nil
+			}
+			if first == nil || result.node == node {
+				if first != nil {
+					discard(*first)
+				}
+				first = &result
+			} else {
+				discard(result)
+			}
+		}
+	}
+	cancel := cancels[first.node]
+	if first.err != nil {
+		cancel()
+	} else {
+		first.resp.Body = &cancelBody{ReadCloser: first.resp.Body, cancel: cancel}
+	}
+	return first.resp, first.node, first.err
+}
@@ -0,0 +1,28 @@
+package cluster
+
+import(
+	"net/http"
+)
+
+// An Interceptor wraps the round trip of every request attempt on a node, e.g. to add headers,
+// rewrite the path or measure latency. Calling next sends the request on to the node.
+type Interceptor func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc adapts a function to an http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func(f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Sends the request to the node through the Interceptors, the first one being the outermost
+func(config *ClusterConfig) doNode(node *Node, req *http.Request) (*http.Response, error) {
+	if len(config.Interceptors) == 0 {
+		return node.Do(req)
+	}
+	var roundTripper http.RoundTripper = RoundTripperFunc(node.Do)
+	for i := len(config.Interceptors) - 1; i >= 0; i-- {
+		roundTripper = config.Interceptors[i](roundTripper)
+	}
+	return roundTripper.RoundTrip(req)
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import(
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Weight of the newest sample in the moving average of a node's latency by default
+const DefaultLatencyDecay = 0.1
+
+func(config *ClusterConfig) latencyDecay() float64 {
+	if config.LatencyDecay <= 0 || config.LatencyDecay > 1 {
+		return DefaultLatencyDecay
+	}
+	return config.LatencyDecay
+}
+
+// Time the latency of a node has to exceed MaxLatency for it to be ejected by default
+const DefaultMaxLatencyWindow = 10 * time.Second
+
+func(config *ClusterConfig) maxLatencyWindow() time.Duration {
+	if config.MaxLatencyWindow <= 0 {
+		return DefaultMaxLatencyWindow
+	}
+	return config.MaxLatencyWindow
+}
+
+// Turns a node whose moving average latency exceeds MaxLatency suspect and evicts it once its
+// latency stayed above for MaxLatencyWindow, so nodes that are up but degraded get replaced
+func(cluster *Cluster) checkLatency(config *ClusterConfig, node *Node) {
+	if config.MaxLatency <= 0 {
+		return
+	}
+	latency := node.Latency()
+	if latency <= config.MaxLatency {
+		node.slowSince.Store(0)
+		return
+	}
+	node.state.CompareAndSwap(int32(NodeHealthy), int32(NodeSuspect))
+	now := time.Now().UnixNano()
+	if node.slowSince.CompareAndSwap(0, now) {
+		return
+	}
+	if time.Duration(now - node.slowSince.Load()) < config.maxLatencyWindow() {
+		return
+	}
+	err := fmt.Errorf("Node %s ejected with a latency of %v exceeding %v", node.Host, latency, config.MaxLatency)
+	if cluster.evict(node, err) {
+		// A reanimated node has to learn its latency anew
+		node.slowSince.Store(0)
+		node.latency.Store(0)
+	}
+}
+
+// Folds the latency of a completed request into the node's moving average
+func(node *Node) observeLatency(latency time.Duration) {
+	decay := math.Float64frombits(node.latencyDecay.Load())
+	if decay == 0 {
+		decay = DefaultLatencyDecay
+	}
+	for {
+		old := node.latency.Load()
+		average := float64(latency)
+		if old != 0 {
+			average = decay * float64(latency) + (1 - decay) * math.Float64frombits(old)
+		}
+		if node.latency.CompareAndSwap(old, math.Float64bits(average)) {
+			return
+		}
+	}
+}
+
+// Exponentially weighted moving average of the time until the node's response headers were
+// received, zero until the node completed a request
+func(node *Node) Latency() time.Duration {
+	return time.Duration(math.Float64frombits(node.latency.Load()))
+}
+
+// LatencyBalancer picks two distinct nodes at random and takes the one with the lower moving
+// average latency weighted by its requests in flight, so faster nodes receive more requests.
+// Nodes without latency yet are preferred to learn it.
+type LatencyBalancer struct {}
+
+func latencyCost(node *Node) float64 {
+	return float64(node.Latency()) * float64(node.InFlight() + 1)
+}
+
+func(balancer *LatencyBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	first := rand.Intn(len(nodes))
+	second := rand.Intn(len(nodes) - 1)
+	if second >= first {
+		second++
+	}
+	if latencyCost(nodes[second]) < latencyCost(nodes[first]) {
+		return nodes[second]
+	}
+	return nodes[first]
+}
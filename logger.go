@@ -0,0 +1,18 @@
+package cluster
+
+// Logger receives the cluster's log lines about node selection, eviction, reanimation and
+// exhaustion, *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type noopLogger struct {}
+
+func(logger noopLogger) Printf(format string, args ...interface{}) {}
+
+func(config *ClusterConfig) logger() Logger {
+	if config.Logger == nil {
+		return noopLogger{}
+	}
+	return config.Logger
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import(
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters of the cluster as a whole
+type clusterMetrics struct {
+	requests 		atomic.Int64
+	failures 		atomic.Int64
+	evictions 		atomic.Int64
+	reanimations 	atomic.Int64
+}
+
+// Serializes checking and publishing expvar names across clusters
+var expvarMutex sync.Mutex
+
+// PublishExpvar registers the cluster's counters with expvar, named after the prefix:
+// prefix.requests and prefix.failures count the calls of Do and those failing, prefix.evictions
+// and prefix.reanimations the nodes evicted and reanimated, and prefix.liveNodes is the number of
+// live nodes. As expvar names cannot be registered twice an error is returned if any of them is
+// taken already, e.g. by another cluster, and none are registered.
+func(cluster *Cluster) PublishExpvar(prefix string) error {
+	vars := map[string]func() any{
+		"requests": func() any { return cluster.metrics.requests.Load() },
+		"failures": func() any { return cluster.metrics.failures.Load() },
+		"evictions": func() any { return cluster.metrics.evictions.Load() },
+		"reanimations": func() any { return cluster.metrics.reanimations.Load() },
+		"liveNodes": func() any { return len(cluster.snapshot().nodes) },
+	}
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	for name := range vars {
+		if expvar.Get(prefix + "." + name) != nil {
+			return fmt.Errorf("Expvar %s.%s is published already", prefix, name)
+		}
+	}
+	for name, value := range vars {
+		expvar.Publish(prefix + "." + name, expvar.Func(value))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import(
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutlierWindow = 10 * time.Second
+	DefaultOutlierMinRequests = 5
+	DefaultOutlierMaxEjection = 0.1
+)
+
+// Error rate of the responses of a node within the current window
+type outlierWindow struct {
+	mutex 		sync.Mutex
+	start 		time.Time
+	requests 	int
+	errors 		int
+}
+
+// Counts the outcome of a request and returns the error rate if the window saw enough requests
+func(window *outlierWindow) record(failed bool, length time.Duration, minRequests int) (rate float64, ok bool) {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(window.start) >= length {
+		window.start, window.requests, window.errors = now, 0, 0
+	}
+	window.requests++
+	if failed {
+		window.errors++
+	}
+	if window.requests < minRequests {
+		return 0, false
+	}
+	return float64(window.errors) / float64(window.requests), true
+}
+
+func(window *outlierWindow) reset() {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	window.start, window.requests, window.errors = time.Time{}, 0, 0
+}
+
+// Tracks the outcome of a request and ejects the node once its rate of errors and 5xx responses
+// within the window exceeds OutlierErrorRate, unless MaxOutlierEjection of the nodes are dead
+// already
+func(cluster *Cluster) detectOutlier(config *ClusterConfig, node *Node, resp *http.Response, err error) {
+	if config.OutlierErrorRate <= 0 {
+		return
+	}
+	window, minRequests := config.OutlierWindow, config.OutlierMinRequests
+	if window <= 0 {
+		window = DefaultOutlierWindow
+	}
+	if minRequests <= 0 {
+		minRequests = DefaultOutlierMinRequests
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	rate, ok := node.outliers.record(failed, window, minRequests)
+	if !ok || rate <= config.OutlierErrorRate {
+		return
+	}
+	maxEjection := config.MaxOutlierEjection
+	if maxEjection <= 0 {
+		maxEjection = DefaultOutlierMaxEjection
+	}
+	if cluster.evictCapped(node, fmt.Errorf("Node %s ejected as outlier with an error rate of %.2f", node.Host, rate), maxEjection) {
+		// A reanimated node starts over with a clean record
+		node.outliers.reset()
+	}
+}
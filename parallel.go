@@ -0,0 +1,183 @@
+package cluster
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Returned by Cluster.DoParallel when asked to race fewer than one node
+var ErrInvalidParallelism = errors.New("Parallel requests need at least one node")
+
+// Sends the request to n distinct live nodes in parallel and returns the first successful
+// response, i.e. one without error and a status below 500, cancelling the other requests. Nodes
+// failing during the race are evicted like in Cluster.Do. If no node succeeds an
+// *AllNodesUnavailableError with the failure of every node is returned. A request with a body
+// needs GetBody set to be sent to more than one node. MaxInFlight, MaxConcurrentPerNode and
+// RatePerNode apply like in Cluster.Do, except that nodes without a free slot or token are left
+// out of the race instead of being waited for.
+func(cluster *Cluster) DoParallel(req *http.Request, n int) (*http.Response, error) {
+	if n < 1 {
+		return nil, ErrInvalidParallelism
+	}
+	if cluster.ctx.Err() != nil {
+		return nil, ErrClusterClosed
+	}
+	state := cluster.snapshot()
+	nodes, balancer, config := state.nodes, state.balancer, state.config
+	if config.MaxInFlight > 0 {
+		if config.BlockWhenSaturated {
+			if err := cluster.inFlight.acquire(req.Context(), config.MaxInFlight); err != nil {
+				return nil, err
+			}
+		} else if !cluster.inFlight.tryAcquire(config.MaxInFlight) {
+			return nil, ErrClusterSaturated
+		}
+		defer cluster.inFlight.release()
+	}
+	breakers := config.BreakerThreshold > 0
+	limit := config.MaxConcurrentPerNode
+	req = config.withDefaultHeaders(req)
+	picked := map[*Node]bool{}
+	skip := func(node *Node) bool {
+		return picked[node] || (breakers && !node.breaker.available(config.BreakerCooldown)) ||
+			node.saturated(limit) || config.rateLimited(node)
+	}
+	var racing []*Node
+	// Frees the slots and breaker trials of the nodes that will not be sent the request
+	abandon := func(nodes []*Node) {
+		for _, node := range nodes {
+			if limit > 0 {
+				cluster.releaseSlot(node)
+			}
+			if breakers {
+				node.breaker.release()
+			}
+		}
+	}
+	for len(racing) < n {
+		node := config.selectNode(nodes, balancer, req, skip)
+		if node == nil {
+			break
+		}
+		picked[node] = true
+		if limit > 0 && !node.acquireSlot(limit) {
+			continue
+		}
+		if !config.takeToken(node) || (breakers && !node.breaker.acquire(config.BreakerCooldown)) {
+			if limit > 0 {
+				cluster.releaseSlot(node)
+			}
+			continue
+		}
+		racing = append(racing, node)
+	}
+	if len(racing) == 0 {
+		if limit > 0 {
+			for _, node := range nodes {
+				if node.saturated(limit) {
+					return nil, ErrNodesSaturated
+				}
+			}
+		}
+		return nil, &AllNodesUnavailableError{}
+	}
+	bodies := make([]io.ReadCloser, len(racing))
+	bodies[0] = req.Body
+	for i := 1; i < len(racing); i++ {
+		nodeReq, err := rewindBody(req)
+		if err != nil {
+			abandon(racing)
+			return nil, err
+		}
+		bodies[i] = nodeReq.Body
+	}
+	results := make(chan hedgeResult, len(racing))
+	cancels := make(map[*Node]context.CancelFunc, len(racing))
+	for i, node := range racing {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[node] = cancel
+		nodeReq := req.Clone(ctx)
+		nodeReq.Body = bodies[i]
+		go func(node *Node) {
+			result := hedgeResult{node: node, err: errCallbackPanicked}
+			defer func() {
+				if limit > 0 {
+					cluster.releaseSlot(node)
+				}
+				results <- result
+			}()
+			config.callback("parallel request", func() {
+				started := time.Now()
+				resp, err := config.doNode(node, nodeReq)
+				result.resp, result.err = resp, err
+				node.stats.record(time.Since(started))
+				config.observeRetryAfter(node, resp)
+				if nodeReq.Context().Err() == nil {
+					cluster.detectOutlier(config, node, resp, err)
+				}
+			})
+		}(node)
+	}
+	config.logger().Printf("Cluster racing %s %s on nodes %v", req.Method, req.URL.Path, nodeHosts(racing))
+	var attempts []NodeAttempt
+	for pending := len(racing); pending > 0; pending-- {
+		result := <-results
+		node := result.node
+		if result.err != nil && req.Context().Err() != nil {
+			// The caller cancelled the request, which says nothing about the health of the node
+			cancels[node]()
+			if breakers {
+				node.breaker.release()
+			}
+			attempts = append(attempts, NodeAttempt{Host: node.Host, Err: result.err})
+			continue
+		}
+		if config.isNodeDead(result.resp, result.err) {
+			err := cluster.nodeFailed(config, node, result.resp, result.err)
+			cancels[node]()
+			discardResponse(result.resp)
+			attempts = append(attempts, NodeAttempt{Host: node.Host, Err: err})
+			continue
+		}
+		if result.err != nil || result.resp.StatusCode >= 500 {
+			nodeErred(config, node)
+			err := result.err
+			if err == nil {
+				err = fmt.Errorf("Node %s responded %s", node.Host, result.resp.Status)
+			}
+			cancels[node]()
+			discardResponse(result.resp)
+			attempts = append(attempts, NodeAttempt{Host: node.Host, Err: err})
+			continue
+		}
+		nodeSucceeded(config, node)
+		cluster.checkLatency(config, node)
+		for other, cancel := range cancels {
+			if other != node {
+				cancel()
+			}
+		}
+		// Losers failing due to their cancellation say nothing about their health
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				loser := <-results
+				if !errors.Is(loser.err, context.Canceled) && config.isNodeDead(loser.resp, loser.err) {
+					cluster.nodeFailed(config, loser.node, loser.resp, loser.err)
+				} else if breakers {
+					loser.node.breaker.release()
+				}
+				discardResponse(loser.resp)
+			}
+		}(pending-1)
+		result.resp.Body = &cancelBody{ReadCloser: result.resp.Body, cancel: cancels[node]}
+		return result.resp, nil
+	}
+	if ctxErr := req.Context().Err(); ctxErr != nil {
+		return nil, contextError(ctxErr, attempts)
+	}
+	return nil, &AllNodesUnavailableError{Attempts: attempts}
+}
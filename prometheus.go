@@ -0,0 +1,61 @@
+//go:build prometheus
+
+package cluster
+
+import(
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusCollector exposes the stats of a cluster's nodes to Prometheus, built with the
+// prometheus build tag. Everything is read from the stats the cluster keeps anyway when
+// collected, register it like any other collector:
+//
+//	prometheus.MustRegister(cluster.NewPrometheusCollector("backend"))
+type PrometheusCollector struct {
+	cluster 	*Cluster
+	requests 	*prometheus.Desc
+	failures 	*prometheus.Desc
+	latency 	*prometheus.Desc
+	liveNodes 	*prometheus.Desc
+	deadNodes 	*prometheus.Desc
+}
+
+// Returns a collector of the cluster's metrics prefixed with the namespace
+func(cluster *Cluster) NewPrometheusCollector(namespace string) *PrometheusCollector {
+	return &PrometheusCollector{
+		cluster: cluster,
+		requests: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "node_requests_total"),
+			"Requests sent to the node.", []string{"host"}, nil),
+		failures: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "node_failures_total"),
+			"Attempts on the node that failed with an error or a 5xx response.", []string{"host"}, nil),
+		latency: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "node_latency_seconds"),
+			"Time until the response headers of the node were received.", []string{"host"}, nil),
+		liveNodes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "live_nodes"),
+			"Nodes requests are balanced across.", nil, nil),
+		deadNodes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "dead_nodes"),
+			"Evicted nodes waiting for their reanimation.", nil, nil),
+	}
+}
+
+func(collector *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.requests
+	ch <- collector.failures
+	ch <- collector.latency
+	ch <- collector.liveNodes
+	ch <- collector.deadNodes
+}
+
+func(collector *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	bounds := LatencyBucketBounds()
+	for host, stats := range collector.cluster.Stats() {
+		ch <- prometheus.MustNewConstMetric(collector.requests, prometheus.CounterValue, float64(stats.Requests), host)
+		ch <- prometheus.MustNewConstMetric(collector.failures, prometheus.CounterValue, float64(stats.Failures), host)
+		buckets := make(map[float64]uint64, len(stats.LatencyBuckets))
+		for idx, count := range stats.LatencyBuckets {
+			buckets[bounds[idx].Seconds()] = uint64(count)
+		}
+		ch <- prometheus.MustNewConstHistogram(collector.latency, uint64(stats.Requests), stats.TotalLatency.Seconds(), buckets, host)
+	}
+	ch <- prometheus.MustNewConstMetric(collector.liveNodes, prometheus.GaugeValue, float64(len(collector.cluster.LiveHosts())))
+	ch <- prometheus.MustNewConstMetric(collector.deadNodes, prometheus.GaugeValue, float64(len(collector.cluster.DeadHosts())))
+}
@@ -0,0 +1,59 @@
+//go:build prometheus
+
+package cluster
+
+import (
+	"testing"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusCollectorExposesNodeStats(t *testing.T) {
+	_, hosts, servers := startStatusServers(t, http.StatusInternalServerError)
+	defer closeTestServers(servers)
+	config := &ClusterConfig{Hosts: append(hosts, "localhost:324786"), Strategy: StrategyRoundRobin, NodeReanimationAfter: time.Hour}
+	cluster, err := NewCluster(config)
+	if err != nil {
+		t.Fatalf("Unexpected error when create cluster with config `%v`: %v", config, err)
+		return
+	}
+	defer cluster.Close()
+	// Whichever node comes first, the dead node is tried once and the erring node twice
+	for i := 0; i<2; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := cluster.Do(req)
+		if err != nil {
+			t.Fatalf("Cluster client on Get request raised error: %v", err)
+			return
+		}
+		discardResponse(resp)
+	}
+	collector := cluster.NewPrometheusCollector("test")
+	expected := fmt.Sprintf(`
+# HELP test_cluster_node_requests_total Requests sent to the node.
+# TYPE test_cluster_node_requests_total counter
+test_cluster_node_requests_total{host="%[1]s"} 2
+test_cluster_node_requests_total{host="localhost:324786"} 1
+# HELP test_cluster_node_failures_total Attempts on the node that failed with an error or a 5xx response.
+# TYPE test_cluster_node_failures_total counter
+test_cluster_node_failures_total{host="%[1]s"} 2
+test_cluster_node_failures_total{host="localhost:324786"} 1
+# HELP test_cluster_live_nodes Nodes requests are balanced across.
+# TYPE test_cluster_live_nodes gauge
+test_cluster_live_nodes 1
+# HELP test_cluster_dead_nodes Evicted nodes waiting for their reanimation.
+# TYPE test_cluster_dead_nodes gauge
+test_cluster_dead_nodes 1
+`, hosts[0])
+	err = testutil.CollectAndCompare(collector, strings.NewReader(expected), "test_cluster_node_requests_total",
+		"test_cluster_node_failures_total", "test_cluster_live_nodes", "test_cluster_dead_nodes")
+	if err != nil {
+		t.Fatalf("Unexpected metrics collected: %v", err)
+	}
+	if count := testutil.CollectAndCount(collector, "test_cluster_node_latency_seconds"); count != 2 {
+		t.Fatalf("Expected a latency histogram per node, got %d", count)
+	}
+}
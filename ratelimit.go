@@ -0,0 +1,81 @@
+package cluster
+
+import(
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the requests per second sent to a node, only used if
+// ClusterConfig.RatePerNode is set
+type tokenBucket struct {
+	mutex 	sync.Mutex
+	tokens 	float64
+	last 	time.Time
+}
+
+func(bucket *tokenBucket) refill(rate float64, burst int, now time.Time) {
+	if bucket.last.IsZero() {
+		bucket.tokens = float64(burst)
+	} else if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * rate
+	}
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.last = now
+}
+
+// Takes a token if one is available
+func(bucket *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(rate, burst, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Time until the next token is available, zero if one is available now
+func(bucket *tokenBucket) wait(rate float64, burst int, now time.Time) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(rate, burst, now)
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+func(config *ClusterConfig) burst() int {
+	if config.Burst <= 0 {
+		return 1
+	}
+	return config.Burst
+}
+
+func(config *ClusterConfig) rateLimited(node *Node) bool {
+	return config.RatePerNode > 0 && node.bucket.wait(config.RatePerNode, config.burst(), time.Now()) > 0
+}
+
+func(config *ClusterConfig) takeToken(node *Node) bool {
+	return config.RatePerNode <= 0 || node.bucket.take(config.RatePerNode, config.burst(), time.Now())
+}
+
+// Time until the first of the nodes not skipped gets its next token, false if none of them is
+// rate limited
+func(config *ClusterConfig) nextToken(nodes []*Node, skip func(*Node) bool) (time.Duration, bool) {
+	now := time.Now()
+	next, limited := time.Duration(0), false
+	for _, node := range nodes {
+		if skip != nil && skip(node) {
+			continue
+		}
+		wait := node.bucket.wait(config.RatePerNode, config.burst(), now)
+		if wait > 0 && (!limited || wait < next) {
+			next, limited = wait, true
+		}
+	}
+	return next, limited
+}
@@ -0,0 +1,29 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefillsAtRate(t *testing.T) {
+	bucket := &tokenBucket{}
+	now := time.Now()
+	for i := 0; i<2; i++ {
+		if !bucket.take(10, 2, now) {
+			t.Fatalf("Expected burst of 2 tokens, ran out after %d", i)
+			return
+		}
+	}
+	if bucket.take(10, 2, now) {
+		t.Fatalf("Expected bucket to be empty after the burst")
+		return
+	}
+	if wait := bucket.wait(10, 2, now); wait != 100*time.Millisecond {
+		t.Fatalf("Expected next token in 100ms, got %v", wait)
+		return
+	}
+	if !bucket.take(10, 2, now.Add(100*time.Millisecond)) {
+		t.Fatalf("Expected a token after 100ms")
+		return
+	}
+}
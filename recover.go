@@ -0,0 +1,53 @@
+package cluster
+
+import(
+	"errors"
+	"runtime/debug"
+)
+
+// Error of a callback that panicked instead of returning
+var errCallbackPanicked = errors.New("Callback panicked")
+
+// Logs a panic recovered by the deferred caller instead of crashing the process
+func(config *ClusterConfig) recovered(what string, r interface{}) {
+	// A Logger panicking on the report has nowhere left to report to
+	defer func() {
+		recover()
+	}()
+	config.logger().Printf("Cluster recovered from panic in %s: %v\n%s", what, r, debug.Stack())
+}
+
+// Calls a callback supplied by the user, a panicking callback is logged and does not take the
+// cluster down
+func(config *ClusterConfig) callback(what string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			config.recovered(what, r)
+		}
+	}()
+	f()
+}
+
+func(config *ClusterConfig) notifyNodeDead(host string, err error) {
+	if config.OnNodeDead != nil {
+		config.callback("OnNodeDead", func() {
+			config.OnNodeDead(host, err)
+		})
+	}
+}
+
+func(config *ClusterConfig) notifyNodeReanimated(host string) {
+	if config.OnNodeReanimated != nil {
+		config.callback("OnNodeReanimated", func() {
+			config.OnNodeReanimated(host)
+		})
+	}
+}
+
+func(config *ClusterConfig) notifyNodePermanentlyRemoved(host string, err error) {
+	if config.OnNodePermanentlyRemoved != nil {
+		config.callback("OnNodePermanentlyRemoved", func() {
+			config.OnNodePermanentlyRemoved(host, err)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import(
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Parses the Retry-After header of the response in both its delta-seconds and HTTP-date form
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(math.MaxInt64 / time.Second) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(seconds)*time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return date.Sub(now), true
+}
+
+// Suspends the node for the duration of the Retry-After header of a 503 response, if
+// ClusterConfig.HonorRetryAfter is set
+func(config *ClusterConfig) observeRetryAfter(node *Node, resp *http.Response) {
+	if !config.HonorRetryAfter || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	delay, ok := retryAfter(resp, now)
+	if !ok || delay <= 0 {
+		return
+	}
+	until := int64(math.MaxInt64)
+	if delay < time.Duration(math.MaxInt64 - now.UnixNano()) {
+		until = now.UnixNano() + int64(delay)
+	}
+	for {
+		current := node.suspendedUntil.Load()
+		if current >= until || node.suspendedUntil.CompareAndSwap(current, until) {
+			break
+		}
+	}
+	config.logger().Printf("Cluster suspended node %s for %v as requested by Retry-After", node.Host, delay)
+}
+
+// Whether the node asked not to get requests for now
+func(node *Node) suspended() bool {
+	until := node.suspendedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
@@ -0,0 +1,51 @@
+package cluster
+
+import(
+	"context"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy overrides the failover settings of the cluster for a single request. Each field
+// set replaces the ClusterConfig field of the same name, nil fields keep the cluster's setting,
+// e.g. with retries := 3, RetryPolicy{MaxRetries: &retries} only changes MaxRetries.
+type RetryPolicy struct {
+	MaxRetries 					*int
+	AllowNonIdempotentRetry 	*bool
+	BackoffBase 				*time.Duration
+	BackoffMax 					*time.Duration
+}
+
+type retryPolicyKey struct {}
+
+// Returns a context making the requests sent with it fail over as the policy says instead of
+// the cluster's config
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func requestRetryPolicy(req *http.Request) (RetryPolicy, bool) {
+	if req == nil {
+		return RetryPolicy{}, false
+	}
+	policy, ok := req.Context().Value(retryPolicyKey{}).(RetryPolicy)
+	return policy, ok
+}
+
+// Returns a copy of the config with the failover settings set by the policy
+func(config *ClusterConfig) withRetryPolicy(policy RetryPolicy) *ClusterConfig {
+	overridden := *config
+	if policy.MaxRetries != nil {
+		overridden.MaxRetries = *policy.MaxRetries
+	}
+	if policy.AllowNonIdempotentRetry != nil {
+		overridden.AllowNonIdempotentRetry = *policy.AllowNonIdempotentRetry
+	}
+	if policy.BackoffBase != nil {
+		overridden.BackoffBase = *policy.BackoffBase
+	}
+	if policy.BackoffMax != nil {
+		overridden.BackoffMax = *policy.BackoffMax
+	}
+	return &overridden
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import(
+	"net/http"
+	"strings"
+)
+
+// Group of the hosts missing from ClusterConfig.Groups and of the requests matching no prefix of
+// ClusterConfig.PathGroups
+const DefaultGroup = "default"
+
+// Node roles for read/write splitting
+const (
+	RolePrimary 	= "primary"
+	RoleReplica 	= "replica"
+)
+
+// Routes writes to primaries and reads to replicas, used when ClusterConfig.Roles is set
+// without ClusterConfig.MethodRoles
+var DefaultMethodRoles = map[string]string{
+	"GET": RoleReplica,
+	"HEAD": RoleReplica,
+	"OPTIONS": RoleReplica,
+	"POST": RolePrimary,
+	"PUT": RolePrimary,
+	"PATCH": RolePrimary,
+	"DELETE": RolePrimary,
+}
+
+// Narrows the candidates down to the nodes the request should be routed to, the balancer then
+// picks among those
+func(config *ClusterConfig) route(candidates []*Node, req *http.Request) []*Node {
+	group, grouped := requestGroup(req)
+	if !grouped && (len(config.Groups) > 0 || len(config.PathGroups) > 0) {
+		group, grouped = config.pathGroup(req), true
+	}
+	if grouped {
+		// Unlike roles and tiers groups are strict, requests fail over within their group only
+		candidates = filterNodes(candidates, func(node *Node) bool {
+			return config.group(node) == group
+		})
+	}
+	if len(config.Roles) > 0 {
+		methodRoles := config.MethodRoles
+		if methodRoles == nil {
+			methodRoles = DefaultMethodRoles
+		}
+		method := req.Method
+		if method == "" {
+			method = "GET"
+		}
+		if role, ok := methodRoles[method]; ok {
+			candidates = preferNodes(candidates, func(node *Node) bool {
+				return config.Roles[node.Host] == role
+			})
+		}
+	}
+	if len(config.Tiers) > 0 || config.SRVService != "" {
+		candidates = config.topTier(candidates)
+	}
+	if config.LocalZone != "" {
+		// Other zones are only failed over to once no node of the local zone is left
+		candidates = preferNodes(candidates, func(node *Node) bool {
+			return config.Zones[node.Host] == config.LocalZone
+		})
+	}
+	return candidates
+}
+
+// Group of the requests to the path, the group of its longest prefix in PathGroups
+func(config *ClusterConfig) pathGroup(req *http.Request) string {
+	group, longest := DefaultGroup, -1
+	for prefix, prefixGroup := range config.PathGroups {
+		if len(prefix) > longest && strings.HasPrefix(req.URL.Path, prefix) {
+			group, longest = prefixGroup, len(prefix)
+		}
+	}
+	return group
+}
+
+func(config *ClusterConfig) group(node *Node) string {
+	if group, ok := config.Groups[node.Host]; ok {
+		return group
+	}
+	return DefaultGroup
+}
+
+// Tier of the node, nodes discovered via SRV records missing from Tiers are in the tier of their
+// record's priority
+func(config *ClusterConfig) tier(node *Node) int {
+	if tier, ok := config.Tiers[node.Host]; ok || !node.srv.Load() {
+		return tier
+	}
+	return int(node.srvPriority.Load())
+}
+
+// Returns the nodes of the best tier present among the given nodes
+func(config *ClusterConfig) topTier(nodes []*Node) []*Node {
+	best := 0
+	for i, node := range nodes {
+		if tier := config.tier(node); i == 0 || tier < best {
+			best = tier
+		}
+	}
+	return preferNodes(nodes, func(node *Node) bool {
+		return config.tier(node) == best
+	})
+}
+
+// Returns the nodes matching the predicate, or all nodes if none matches so requests fall back
+// to any node rather than failing
+func preferNodes(nodes []*Node, predicate func(*Node) bool) []*Node {
+	preferred := filterNodes(nodes, predicate)
+	if len(preferred) == 0 {
+		return nodes
+	}
+	return preferred
+}
+
+func filterNodes(nodes []*Node, predicate func(*Node) bool) []*Node {
+	filtered := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if predicate(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import(
+	"context"
+	"net/http"
+)
+
+// A Selector picks the node for a single request out of the nodes it may be sent to, like a
+// Balancer it must not retain or modify the nodes. Returning nil or a node not among them leaves
+// the choice to the cluster's balancer.
+type Selector func(nodes []*Node) *Node
+
+type selectorKey struct {}
+
+// Returns a context making the requests sent with it select their nodes with the selector.
+// Routing, eviction and failover still apply, the selector is asked again on every attempt with
+// the nodes left.
+func WithSelector(ctx context.Context, selector Selector) context.Context {
+	return context.WithValue(ctx, selectorKey{}, selector)
+}
+
+// DoSelect works like Do but selects the nodes for the request with the selector
+func(cluster *Cluster) DoSelect(req *http.Request, selector Selector) (*http.Response, error) {
+	return cluster.Do(req.WithContext(WithSelector(req.Context(), selector)))
+}
+
+func requestSelector(req *http.Request) Selector {
+	if req == nil {
+		return nil
+	}
+	selector, _ := req.Context().Value(selectorKey{}).(Selector)
+	return selector
+}
@@ -0,0 +1,36 @@
+package cluster
+
+import(
+	"math/rand"
+	"time"
+)
+
+// Fraction of its regular share of requests the node receives while ramping up after its
+// reanimation, 1 once SlowStartDuration passed
+func(config *ClusterConfig) slowStartFactor(node *Node, now time.Time) float64 {
+	reanimatedAt := node.reanimatedAt.Load()
+	if config.SlowStartDuration <= 0 || reanimatedAt == 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, reanimatedAt))
+	if elapsed >= config.SlowStartDuration {
+		return 1
+	}
+	if elapsed < 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(config.SlowStartDuration)
+}
+
+// Leaves each node ramping up among the candidates with a probability growing linearly from 0
+// to 1 over SlowStartDuration. Ramping nodes are kept if no other node is left.
+func(config *ClusterConfig) slowStart(candidates []*Node) []*Node {
+	if config.SlowStartDuration <= 0 {
+		return candidates
+	}
+	now := time.Now()
+	return preferNodes(candidates, func(node *Node) bool {
+		factor := config.slowStartFactor(node, now)
+		return factor >= 1 || rand.Float64() < factor
+	})
+}
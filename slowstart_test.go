@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowStartFactorRampsUpLinearly(t *testing.T) {
+	config := &ClusterConfig{SlowStartDuration: 10*time.Second}
+	node := NewNode("localhost:1")
+	now := time.Now()
+	if factor := config.slowStartFactor(node, now); factor != 1 {
+		t.Fatalf("Expected node never reanimated to get its full share, got %v", factor)
+		return
+	}
+	node.reanimatedAt.Store(now.Add(-2500*time.Millisecond).UnixNano())
+	if factor := config.slowStartFactor(node, now); factor != 0.25 {
+		t.Fatalf("Expected a quarter share after a quarter of the ramp, got %v", factor)
+		return
+	}
+	node.reanimatedAt.Store(now.Add(-time.Minute).UnixNano())
+	if factor := config.slowStartFactor(node, now); factor != 1 {
+		t.Fatalf("Expected full share after the ramp, got %v", factor)
+		return
+	}
+	nodes := []*Node{NewNode("localhost:2"), node}
+	node.reanimatedAt.Store(time.Now().UnixNano())
+	if picked := config.selectNode(nodes, &lastNodeBalancer{}, nil, nil); picked != nodes[0] {
+		t.Fatalf("Expected node starting its ramp to be passed over, got %s", picked.Host)
+		return
+	}
+}
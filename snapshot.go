@@ -0,0 +1,23 @@
+package cluster
+
+// Live nodes, balancer and config of the cluster as published by the last change, read by
+// requests without taking a lock
+type clusterState struct {
+	nodes 		[]*Node
+	balancer 	Balancer
+	config 		*ClusterConfig
+}
+
+// Publishes the current nodes, balancer and config to requests. The caller must hold the
+// NodesMutex for writing, the nodes are never modified once published.
+func(cluster *Cluster) publish() {
+	config := cluster.config
+	if balancer, ok := cluster.balancer.(liveNodesBalancer); ok {
+		balancer.setLiveNodes(cluster.Nodes)
+	}
+	cluster.state.Store(&clusterState{nodes: cluster.Nodes, balancer: cluster.balancer, config: &config})
+}
+
+func(cluster *Cluster) snapshot() *clusterState {
+	return cluster.state.Load()
+}
@@ -0,0 +1,57 @@
+package cluster
+
+import(
+	"math/rand"
+)
+
+type NodeState int32
+
+const (
+	// The node receives its full share of requests
+	NodeHealthy NodeState = iota
+	// The node failed recently or was just reanimated, it receives a reduced share of requests
+	// as configured by ClusterConfig.SuspectShare until it served a request successfully
+	NodeSuspect
+	// The node was evicted and waits in the dead pool for its reanimation
+	NodeDead
+	// The node was removed from the cluster and finishes its requests in flight
+	NodeDraining
+	// The node was removed from the cluster and drained
+	NodeRemoved
+)
+
+func(state NodeState) String() string {
+	switch state {
+	case NodeHealthy:
+		return "healthy"
+	case NodeSuspect:
+		return "suspect"
+	case NodeDead:
+		return "dead"
+	case NodeDraining:
+		return "draining"
+	case NodeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+func(node *Node) State() NodeState {
+	return NodeState(node.state.Load())
+}
+
+func(node *Node) setState(state NodeState) {
+	node.state.Store(int32(state))
+}
+
+// Leaves each suspect node among the candidates with a probability of SuspectShare, so suspect
+// nodes receive that share of the requests they would receive if healthy. Suspect nodes are
+// kept if no healthy node is left.
+func(config *ClusterConfig) thinSuspects(candidates []*Node) []*Node {
+	if config.SuspectShare <= 0 || config.SuspectShare >= 1 {
+		return candidates
+	}
+	return preferNodes(candidates, func(node *Node) bool {
+		return node.State() != NodeSuspect || rand.Float64() < config.SuspectShare
+	})
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import(
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets the latencies of a node's requests are counted in
+var latencyBuckets = [...]time.Duration{
+	5*time.Millisecond, 10*time.Millisecond, 25*time.Millisecond, 50*time.Millisecond,
+	100*time.Millisecond, 250*time.Millisecond, 500*time.Millisecond,
+	time.Second, 2500*time.Millisecond, 5*time.Second, 10*time.Second,
+}
+
+// Counters of the requests a node served, successes being attempts answered without error and
+// with a status below 500 and failures all other attempts, whether the node was considered dead
+// for them or not
+type NodeStats struct {
+	Requests 		int64
+	Successes 		int64
+	Failures 		int64
+	// Accumulated time until the response headers were received
+	TotalLatency 	time.Duration
+	// Number of requests at most as slow as the bound of the same index in LatencyBucketBounds,
+	// cumulative like the buckets of a histogram. Requests slower than the largest bound are
+	// only counted in Requests.
+	LatencyBuckets 	[len(latencyBuckets)]int64
+}
+
+// Upper bounds of the latency buckets of NodeStats
+func LatencyBucketBounds() []time.Duration {
+	return append([]time.Duration(nil), latencyBuckets[:]...)
+}
+
+func(stats NodeStats) AverageLatency() time.Duration {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return stats.TotalLatency / time.Duration(stats.Requests)
+}
+
+type nodeStats struct {
+	requests 	atomic.Int64
+	successes 	atomic.Int64
+	failures 	atomic.Int64
+	latency 	atomic.Int64
+	buckets 	[len(latencyBuckets)]atomic.Int64
+}
+
+func(stats *nodeStats) record(latency time.Duration) {
+	stats.requests.Add(1)
+	stats.latency.Add(int64(latency))
+	idx := sort.Search(len(latencyBuckets), func(i int) bool { return latencyBuckets[i] >= latency })
+	if idx < len(latencyBuckets) {
+		stats.buckets[idx].Add(1)
+	}
+}
+
+func(node *Node) Stats() NodeStats {
+	// The buckets are read first, requests are counted before their bucket so the total never
+	// falls below the buckets
+	var buckets [len(latencyBuckets)]int64
+	var cumulative int64
+	for idx := range latencyBuckets {
+		cumulative += node.stats.buckets[idx].Load()
+		buckets[idx] = cumulative
+	}
+	return NodeStats{
+		Requests: node.stats.requests.Load(),
+		Successes: node.stats.successes.Load(),
+		Failures: node.stats.failures.Load(),
+		TotalLatency: time.Duration(node.stats.latency.Load()),
+		LatencyBuckets: buckets,
+	}
+}
+
+// Stats of all live and dead nodes by host, safe to call concurrently with Do
+func(cluster *Cluster) Stats() map[string]NodeStats {
+	cluster.NodesMutex.RLock()
+	defer cluster.NodesMutex.RUnlock()
+	cluster.DeadPoolMutex.RLock()
+	defer cluster.DeadPoolMutex.RUnlock()
+	stats := make(map[string]NodeStats, len(cluster.Nodes) + len(cluster.DeadPool))
+	for _, node := range cluster.Nodes {
+		stats[node.Host] = node.Stats()
+	}
+	for _, node := range cluster.DeadPool {
+		stats[node.Host] = node.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeStatsCountLatencyBuckets(t *testing.T) {
+	node := NewNode("localhost:1")
+	for _, latency := range []time.Duration{time.Millisecond, 5*time.Millisecond, 20*time.Millisecond, time.Minute} {
+		node.stats.record(latency)
+	}
+	stats := node.Stats()
+	bounds := LatencyBucketBounds()
+	for idx, bound := range bounds {
+		expected := int64(3)
+		if bound < 20*time.Millisecond {
+			expected = 2
+		}
+		if stats.LatencyBuckets[idx] != expected {
+			t.Fatalf("Expected %d requests of at most %v, got %d", expected, bound, stats.LatencyBuckets[idx])
+		}
+	}
+	if stats.Requests != 4 {
+		t.Fatalf("Expected slower requests to be counted in the total, got %d", stats.Requests)
+	}
+}
@@ -0,0 +1,176 @@
+package cluster
+
+import(
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+	"sort"
+)
+
+// Number of sessions a StickySessionBalancer keeps mapped by default
+const DefaultMaxSessions = 100000
+
+// Routes by the value of the given cookie, requests without it are not sticky
+func CookieHashKey(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// StickySessionBalancer keeps sending the requests of a session to the node its first request
+// was sent to. The session is mapped to another node once its node died or was removed, or the
+// session was idle for longer than TTL. While its node is merely unavailable for a request,
+// e.g. because it was tried already, the request is sent elsewhere without remapping the session.
+// Sessions of nodes that left the live nodes of the cluster are dropped.
+type StickySessionBalancer struct {
+	// SessionKey extracts the session of a request, e.g. HeaderHashKey or CookieHashKey. Requests
+	// without session are balanced like new sessions without being mapped.
+	SessionKey 	func(*http.Request) string
+	// TTL is how long an idle session stays mapped, zero keeps sessions mapped for as long as
+	// their node is alive
+	TTL 		time.Duration
+	// Balancer picks the node of new sessions, defaults to a RandomBalancer
+	Balancer 	Balancer
+	// MaxSessions caps the sessions kept mapped, once reached the least recently used quarter is
+	// dropped. Defaults to DefaultMaxSessions.
+	MaxSessions 	int
+	mutex 		sync.Mutex
+	sessions 	map[string]*stickySession
+	swept 		time.Time
+}
+
+type stickySession struct {
+	node 		*Node
+	lastUsed 	time.Time
+}
+
+func(balancer *StickySessionBalancer) Pick(nodes []*Node, req *http.Request) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	key := ""
+	if balancer.SessionKey != nil && req != nil {
+		key = balancer.SessionKey(req)
+	}
+	if key == "" {
+		return balancer.pickNew(nodes, req)
+	}
+	now := time.Now()
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	balancer.sweep(now)
+	session, ok := balancer.sessions[key]
+	if ok && balancer.expired(session, now) {
+		ok = false
+	}
+	if ok {
+		for _, node := range nodes {
+			if node == session.node {
+				session.lastUsed = now
+				return node
+			}
+		}
+		if state := session.node.State(); state != NodeDead && state != NodeDraining && state != NodeRemoved {
+			return balancer.pickNew(nodes, req)
+		}
+	}
+	node := balancer.pickNew(nodes, req)
+	if node != nil {
+		if balancer.sessions == nil {
+			balancer.sessions = map[string]*stickySession{}
+		}
+		if _, mapped := balancer.sessions[key]; !mapped && len(balancer.sessions) >= balancer.maxSessions() {
+			balancer.dropLeastRecentlyUsed()
+		}
+		balancer.sessions[key] = &stickySession{node: node, lastUsed: now}
+	}
+	return node
+}
+
+func(balancer *StickySessionBalancer) pickNew(nodes []*Node, req *http.Request) *Node {
+	if balancer.Balancer == nil {
+		return nodes[rand.Intn(len(nodes))]
+	}
+	return balancer.Balancer.Pick(nodes, req)
+}
+
+func(balancer *StickySessionBalancer) expired(session *stickySession, now time.Time) bool {
+	return balancer.TTL > 0 && now.Sub(session.lastUsed) > balancer.TTL
+}
+
+// Drops the expired sessions at most once per TTL so idle sessions do not pile up
+func(balancer *StickySessionBalancer) sweep(now time.Time) {
+	if balancer.TTL <= 0 || now.Sub(balancer.swept) < balancer.TTL {
+		return
+	}
+	balancer.swept = now
+	for key, session := range balancer.sessions {
+		if balancer.expired(session, now) {
+			delete(balancer.sessions, key)
+		}
+	}
+}
+
+func(balancer *StickySessionBalancer) maxSessions() int {
+	if balancer.MaxSessions > 0 {
+		return balancer.MaxSessions
+	}
+	return DefaultMaxSessions
+}
+
+// Drops the least recently used quarter of the sessions at once so the cost is spread over the
+// sessions added until the cap is reached again. The caller must hold the mutex.
+func(balancer *StickySessionBalancer) dropLeastRecentlyUsed() {
+	used := make([]time.Time, 0, len(balancer.sessions))
+	for _, session := range balancer.sessions {
+		used = append(used, session.lastUsed)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Before(used[j]) })
+	cutoff := used[len(used)/4]
+	for key, session := range balancer.sessions {
+		if !session.lastUsed.After(cutoff) {
+			delete(balancer.sessions, key)
+		}
+	}
+}
+
+// Drops the sessions of nodes no longer live, which would be remapped on their next request
+// anyway, and passes the live nodes on to the balancer of new sessions
+func(balancer *StickySessionBalancer) setLiveNodes(nodes []*Node) {
+	if inner, ok := balancer.Balancer.(liveNodesBalancer); ok {
+		inner.setLiveNodes(nodes)
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	live := make(map[*Node]bool, len(nodes))
+	for _, node := range nodes {
+		live[node] = true
+	}
+	for key, session := range balancer.sessions {
+		if !live[session.node] {
+			delete(balancer.sessions, key)
+		}
+	}
+}
+
+// Takes over the sessions of the sticky balancer it replaces, nodes are kept across config
+// updates so the sessions stay with their nodes
+func(balancer *StickySessionBalancer) inherit(previous Balancer) {
+	sticky, ok := previous.(*StickySessionBalancer)
+	if !ok || sticky == balancer {
+		return
+	}
+	sticky.mutex.Lock()
+	defer sticky.mutex.Unlock()
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	balancer.sessions = make(map[string]*stickySession, len(sticky.sessions))
+	for key, session := range sticky.sessions {
+		balancer.sessions[key] = &stickySession{node: session.node, lastUsed: session.lastUsed}
+	}
+}
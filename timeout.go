@@ -0,0 +1,44 @@
+package cluster
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Returned for attempts that did not receive the response headers within AttemptTimeout, nodes
+// are considered dead for it
+var ErrAttemptTimeout = errors.New("Attempt timed out")
+
+// Limits the time until the response headers of the attempt are received to AttemptTimeout. The
+// returned finish has to be called with the outcome of the attempt, it stops the timer and turns
+// the error of a timed out attempt into ErrAttemptTimeout.
+func(config *ClusterConfig) withAttemptTimeout(req *http.Request) (*http.Request, func(*http.Response, error) (*http.Response, error)) {
+	timeout := config.AttemptTimeout
+	if timeout <= 0 {
+		return req, func(resp *http.Response, err error) (*http.Response, error) {
+			return resp, err
+		}
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	// Unlike a deadline the timer leaves reading the body unlimited once it was stopped
+	timer := time.AfterFunc(timeout, func() {
+		cancel(ErrAttemptTimeout)
+	})
+	finish := func(resp *http.Response, err error) (*http.Response, error) {
+		timer.Stop()
+		if err != nil {
+			timedOut := context.Cause(ctx) == ErrAttemptTimeout && req.Context().Err() == nil
+			cancel(nil)
+			if timedOut {
+				err = fmt.Errorf("%w after %v", ErrAttemptTimeout, timeout)
+			}
+			return resp, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+		return resp, nil
+	}
+	return req.WithContext(ctx), finish
+}
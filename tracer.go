@@ -0,0 +1,32 @@
+package cluster
+
+import(
+	"context"
+	"net/http"
+)
+
+// Tracer starts a span for every attempt to forward a request to a node, e.g. by adapting an
+// OpenTelemetry tracer. The returned context is used for the attempt's request so spans of
+// the transport become children of the attempt.
+type Tracer interface {
+	StartAttempt(ctx context.Context, host string, attempt int) (context.Context, AttemptSpan)
+}
+
+type AttemptSpan interface {
+	// End finishes the span with the attempt's error, if it failed, and whether the request
+	// fails over to another node
+	End(err error, failover bool)
+}
+
+type noopSpan struct {}
+
+func(span noopSpan) End(err error, failover bool) {}
+
+// Starts the span of an attempt, returning req unchanged and a no-op span without a tracer
+func(config *ClusterConfig) startAttempt(req *http.Request, host string, attempt int) (*http.Request, AttemptSpan) {
+	if config.Tracer == nil {
+		return req, noopSpan{}
+	}
+	ctx, span := config.Tracer.StartAttempt(req.Context(), host, attempt)
+	return req.WithContext(ctx), span
+}
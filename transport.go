@@ -0,0 +1,126 @@
+package cluster
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returned when connecting to a node took longer than DialTimeout, nodes are considered
+// unreachable for it
+var ErrDialTimeout = errors.New("Dialing the node timed out")
+
+// Builds the client of a cluster the clients of its nodes are copied from
+func(config *ClusterConfig) newClient() http.Client {
+	client := http.Client{}
+	if config.HTTPClient != nil {
+		client = *config.HTTPClient
+	}
+	if client.Transport == nil {
+		client.Transport = config.newTransport()
+	}
+	return client
+}
+
+// Builds the transport of a cluster, nil keeps http.DefaultTransport
+func(config *ClusterConfig) newTransport() http.RoundTripper {
+	if config.TLSClientConfig == nil && !config.DisableKeepAlives && !config.ForceHTTP2 && config.DialContext == nil &&
+		config.DialTimeout == 0 && config.Proxy == nil && config.MaxIdleConns == 0 &&
+		config.MaxIdleConnsPerHost == 0 && config.IdleConnTimeout == 0 {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.TLSClientConfig
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	if config.DialContext != nil {
+		transport.DialContext = config.DialContext
+	}
+	if config.DialTimeout > 0 {
+		dial, timeout := transport.DialContext, config.DialTimeout
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialCtx, cancel := context.WithTimeoutCause(ctx, timeout, ErrDialTimeout)
+			defer cancel()
+			conn, err := dial(dialCtx, network, addr)
+			if err != nil && context.Cause(dialCtx) == ErrDialTimeout && ctx.Err() == nil {
+				err = fmt.Errorf("%w after %v: %v", ErrDialTimeout, timeout, err)
+			}
+			return conn, err
+		}
+	}
+	if config.Proxy != nil {
+		transport.Proxy = config.Proxy
+	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.ForceHTTP2 {
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return transport
+}
+
+// Prefix of hosts naming the path of a Unix domain socket, e.g. "unix:/var/run/app.sock"
+const UnixHostPrefix = "unix:"
+
+// Host requests to Unix socket nodes are addressed to
+const unixPlaceholderHost = "localhost"
+
+// Returns the socket path of a Unix socket host
+func unixSocket(host string) (string, bool) {
+	if !strings.HasPrefix(host, UnixHostPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, UnixHostPrefix), true
+}
+
+// Derives a transport dialing the socket at path with its dialer from the given one, which has
+// to be an *http.Transport to keep its settings
+func unixTransport(base http.RoundTripper, path string) http.RoundTripper {
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.Proxy = nil
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+	return transport
+}
+
+// Client the node of the host sends its requests with, a copy of the cluster's client with a
+// transport of its own so the connections of the node can be closed on their own. The cluster's
+// *http.Transport is only the template cloned for every node, custom transports other than
+// *http.Transport cannot be cloned and are shared.
+func(cluster *Cluster) nodeClient(host string) *http.Client {
+	client := cluster.Client
+	if path, ok := unixSocket(host); ok {
+		client.Transport = unixTransport(client.Transport, path)
+		return &client
+	}
+	switch transport := client.Transport.(type) {
+	case nil:
+		client.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		client.Transport = transport.Clone()
+	}
+	return &client
+}
@@ -0,0 +1,23 @@
+// Package yamlconfig loads cluster configs from YAML files. It lives in a package of its own so
+// the core package does not depend on gopkg.in/yaml.v3.
+package yamlconfig
+
+import(
+	"fmt"
+	"io"
+
+	"github.com/mbiermann/go-cluster"
+	"gopkg.in/yaml.v3"
+)
+
+// Reads a cluster.FileConfig in YAML and turns it into a validated cluster.ClusterConfig, like
+// cluster.LoadConfigJSON. Unknown fields are rejected so misspelt settings do not go unnoticed.
+func LoadConfig(r io.Reader) (*cluster.ClusterConfig, error) {
+	var file cluster.FileConfig
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("Invalid cluster config: %v", err)
+	}
+	return file.ClusterConfig()
+}
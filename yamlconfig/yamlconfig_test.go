@@ -0,0 +1,47 @@
+package yamlconfig
+
+import (
+	"testing"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mbiermann/go-cluster"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file, err := os.Open("testdata/cluster.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error when opening fixture: %v", err)
+		return
+	}
+	defer file.Close()
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("Unexpected error when loading config: %v", err)
+		return
+	}
+	if len(config.Hosts) != 2 || config.Hosts[0] != "localhost:8080" || config.Hosts[1] != "localhost:8081" {
+		t.Fatalf("Expected the hosts of the file, got %v", config.Hosts)
+	}
+	if config.Strategy != cluster.StrategyRoundRobin || config.Weights["localhost:8080"] != 3 || config.Tiers["localhost:8081"] != 1 {
+		t.Fatalf("Expected the balancing settings of the file, got %+v", config)
+	}
+	if config.Scheme != "https" || config.MaxRetries != 2 || len(config.RetriableStatusCodes) != 2 ||
+		config.FailureThreshold != 3 || config.HealthCheckPath != "/health" {
+		t.Fatalf("Expected the request settings of the file, got %+v", config)
+	}
+	if config.AttemptTimeout != 250*time.Millisecond || config.NodeReanimationAfter != time.Minute {
+		t.Fatalf("Expected the durations of the file, got %v and %v", config.AttemptTimeout, config.NodeReanimationAfter)
+	}
+	invalid := map[string]string{
+		"hosts: [localhost:8080]\ntimeout: 1s\n": "field timeout not found",
+		"hosts: [localhost:8080]\ndialTimeout: soon\n": `Invalid dialTimeout "soon"`,
+		"hosts: []\n": cluster.ErrNoHosts.Error(),
+	}
+	for input, expected := range invalid {
+		if _, err := LoadConfig(strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected error containing `%s` for %q, got %v", expected, input, err)
+		}
+	}
+}